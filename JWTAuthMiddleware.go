@@ -14,34 +14,59 @@ import (
 // JWTAuthMiddleware 是一个 Gin 中间件，用于验证 JWT token
 // 用户于客户端app/api验证
 func JWTAuthMiddleware(jwtSecret []byte) gin.HandlerFunc {
-	return func(c *gin.Context) {
+	return JWTAuthWithOptions(HMACKeyfunc(jwtSecret), JWTAuthOptions{})
+}
+
+// JWTAuthKeySetMiddleware 与 JWTAuthMiddleware 相同，但使用公钥校验
+// 支持 RS256/ES256/EdDSA 等非对称签名，公钥按 token 头部的 kid 从 KeySet 中选出
+func JWTAuthKeySetMiddleware(keys *KeySet) gin.HandlerFunc {
+	return JWTAuthWithOptions(keys.Keyfunc, JWTAuthOptions{})
+}
+
+// JWTAuthWithOptions 使用指定的密钥与校验策略验证 JWT token
+// 例如 JWTAuthWithOptions(HMACKeyfunc(secret), JWTAuthOptions{Issuers: []string{"passport"}, Audience: "app"})
+func JWTAuthWithOptions(keyFunc jwt.Keyfunc, opts JWTAuthOptions) gin.HandlerFunc {
+	return authMiddleware(BearerAuthenticator(keyFunc, opts))
+}
+
+// BearerAuthenticator JWTAuthWithOptions 的认证步骤，可在 AuthRegistry 中使用
+func BearerAuthenticator(keyFunc jwt.Keyfunc, opts JWTAuthOptions) Authenticator {
+	return func(c *gin.Context) bool {
+		setAuthScheme(c, SchemeBearer)
+		stripUntrustedIdentityHeaders(c)
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			log.Log(c.Request.Context()).Error("authorization header is required")
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "authorization header is required"})
-			c.Abort()
-			return
+			abortAuth(c, AuthCodeMissingHeader, "authorization header is required")
+			return false
 		}
 
 		parts := strings.SplitN(authHeader, " ", 2)
 		if len(parts) != 2 || parts[0] != "Bearer" {
 			log.Log(c.Request.Context()).WithField("authHeader", authHeader).
 				Error("authorization header is required")
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "authorization header format must be Bearer {token}"})
-			c.Abort()
-			return
+			abortAuth(c, AuthCodeMalformedHeader, "authorization header format must be Bearer {token}")
+			return false
 		}
 
 		tokenString := parts[1]
 
-		token, claims, err := parseToken(tokenString, jwtSecret)
+		token, claims, err := parseToken(tokenString, keyFunc)
 		if err != nil || !token.Valid {
 			// invalid token
 			log.Log(c.Request.Context()).WithField("authHeader", authHeader).
 				Error(err)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
-			c.Abort()
-			return
+			recordAuthFailure(c, tokenFailureCode(err))
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token", "code": AuthCodeInvalidToken})
+			return false
+		}
+
+		// 校验 exp/nbf/iat/iss/aud
+		aud, claimErr := opts.validate(claims)
+		if claimErr != nil {
+			log.Log(c.Request.Context()).WithField("code", claimErr.code).Error(claimErr)
+			abortAuth(c, claimErr.code, claimErr.msg)
+			return false
 		}
 
 		// 将 claims 保存到上下文
@@ -50,56 +75,92 @@ func JWTAuthMiddleware(jwtSecret []byte) gin.HandlerFunc {
 		accountId, ok := claims["sub"].(string)
 		if !ok || accountId == "" {
 			log.Log(c.Request.Context()).Error("accountId not found")
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token subject"})
-			c.Abort()
-			return
+			abortAuth(c, AuthCodeInvalidSubject, "invalid token subject")
+			return false
 		}
 		c.Set("accountId", accountId)
-
-		iss, ok := claims["iss"].(string)
-		if !ok {
-			log.Log(c.Request.Context()).Error("iss not found")
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token subject"})
-			c.Abort()
-			return
-		}
-		c.Set("iss", iss)
-
-		aud, ok := claims["aud"].(string)
-		if !ok {
-			log.Log(c.Request.Context()).Error("aud not found")
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token subject"})
-			c.Abort()
-			return
-		}
+		c.Set("iss", claims["iss"].(string))
 		c.Set("aud", aud)
 
 		jti, ok := claims["jti"].(string)
 		if !ok {
 			log.Log(c.Request.Context()).Error("jti not found")
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token subject"})
-			c.Abort()
-			return
+			abortAuth(c, AuthCodeMissingClaim, "jti not found")
+			return false
 		}
 		c.Set("jti", jti)
-		tenantId := c.Request.Header.Get("X-Tenant-ID")
-		ctx := context.WithValue(c.Request.Context(), model.MerchantKey, tenantId)
-		ctx = context.WithValue(ctx, model.AccountKey, accountId)
-		c.Request = c.Request.WithContext(ctx)
-		c.Next()
+		scopes := scopeClaim(claims)
+		c.Set("scopes", scopes)
+
+		iat, _, _ := numericClaim(claims, "iat")
+		revoked, err := IsTokenRevoked(c.Request.Context(), jti, accountId, iat)
+		if err != nil {
+			log.Log(c.Request.Context()).WithField("jti", jti).Error(err)
+			abortUnavailable(c, AuthCodeRevocationUnavailable, "token revocation check is unavailable")
+			return false
+		}
+		if revoked {
+			abortAuth(c, AuthCodeTokenRevoked, "token has been revoked")
+			return false
+		}
+
+		tenant, _ := claims[TenantClaim].(string)
+		return bindBearerContext(c, accountId, tenant, scopes)
+	}
+}
+
+// bindBearerContext 将 bearer token 的账号、租户与 scope 写入请求上下文
+// tenant 来自已校验的 claim 或内省结果，为空时数据范围沿用 X-Tenant-ID，但 Identity 中不带租户
+// X-Tenant-ID 与 token 中的租户不一致时返回 403
+func bindBearerContext(c *gin.Context, accountId string, tenant string, scopes []string) bool {
+	scope := c.Request.Header.Get(TenantIDHeader)
+	if tenant != "" && scope != "" && scope != tenant {
+		log.Log(c.Request.Context()).WithField("tenant", tenant).
+			WithField("requested", scope).Warn("tenant does not match token")
+		recordAuthFailure(c, AuthCodeTenantMismatch)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "tenant does not match token", "code": AuthCodeTenantMismatch})
+		return false
+	}
+	if tenant != "" {
+		scope = tenant
 	}
+	ctx := context.WithValue(c.Request.Context(), model.MerchantKey, scope)
+	ctx = context.WithValue(ctx, model.AccountKey, accountId)
+	ctx = withIdentity(ctx, LoginInfo{AccountID: accountId, MerchantID: tenant})
+	ctx = withScopes(ctx, scopes)
+	c.Request = c.Request.WithContext(ctx)
+	return true
+}
+
+// abortAuth 返回 401 以及对应的错误码
+func abortAuth(c *gin.Context, code string, msg string) {
+	recordAuthFailure(c, code)
+	c.JSON(http.StatusUnauthorized, gin.H{"error": msg, "code": code})
+	c.Abort()
 }
 
-// 解析 JWT token
-func parseToken(tokenString string, jwtSecret []byte) (*jwt.Token, jwt.MapClaims, error) {
+// abortUnavailable 依赖的存储不可用时返回 503，避免客户端当作凭证失效处理
+func abortUnavailable(c *gin.Context, code string, msg string) {
+	recordAuthFailure(c, code)
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": msg, "code": code})
+	c.Abort()
+}
+
+// 解析 JWT token，不接受服务间调用的身份断言
+// 时间相关的 claims 由 JWTAuthOptions 统一校验，以便支持 leeway
+func parseToken(tokenString string, keyFunc jwt.Keyfunc) (*jwt.Token, jwt.MapClaims, error) {
 	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(tokenString, claims, rejectIdentityAssertion(keyFunc))
+	return token, claims, err
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+// HMACKeyfunc 仅接受 HMAC 签名的 token
+func HMACKeyfunc(jwtSecret []byte) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 		return jwtSecret, nil
-	})
-
-	return token, claims, err
+	}
 }
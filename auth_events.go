@@ -0,0 +1,70 @@
+package middle
+
+import (
+	"errors"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 认证失败原因，补充 AuthCode* 中没有的情况
+const (
+	AuthCodeMissingCookie      = "missing_cookie"
+	AuthCodeInvalidSignature   = "invalid_signature"
+	AuthCodeSecondFactorFailed = "second_factor_failed"
+	AuthCodeSecondFactorLocked = "second_factor_locked"
+	AuthCodeRouteDenied        = "route_denied"
+	AuthCodeUnauthenticated    = "unauthenticated"
+)
+
+// gin 上下文中的 key
+const (
+	authSchemeKey  = "authScheme"
+	authFailureKey = "authFailure"
+)
+
+// setAuthScheme 记录本次请求使用的认证方式，供 tracing 与 metrics 使用
+func setAuthScheme(c *gin.Context, scheme AuthScheme) {
+	c.Set(authSchemeKey, scheme)
+}
+
+// AuthSchemeOf 返回本次请求使用的认证方式，未经过认证时为空
+func AuthSchemeOf(c *gin.Context) AuthScheme {
+	scheme, _ := c.Value(authSchemeKey).(AuthScheme)
+	return scheme
+}
+
+// AuthFailureOf 返回本次请求认证失败的原因，未失败时为空
+func AuthFailureOf(c *gin.Context) string {
+	return c.GetString(authFailureKey)
+}
+
+// recordAuthFailure 记录认证失败原因，并在当前 span 上添加事件
+func recordAuthFailure(c *gin.Context, reason string) {
+	c.Set(authFailureKey, reason)
+	recordAuthOutcome(AuthSchemeOf(c), reason)
+	span := trace.SpanFromContext(c.Request.Context())
+	span.AddEvent("auth.failure", trace.WithAttributes(
+		attribute.String("auth.scheme", string(AuthSchemeOf(c))),
+		attribute.String("auth.reason", reason),
+	))
+}
+
+// tokenFailureCode 将 jwt 解析错误转换为失败原因
+func tokenFailureCode(err error) string {
+	var ve *jwt.ValidationError
+	if !errors.As(err, &ve) {
+		return AuthCodeInvalidToken
+	}
+	switch {
+	case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return AuthCodeInvalidSignature
+	case ve.Errors&jwt.ValidationErrorExpired != 0:
+		return AuthCodeTokenExpired
+	case ve.Errors&jwt.ValidationErrorNotValidYet != 0:
+		return AuthCodeTokenNotYet
+	}
+	return AuthCodeInvalidToken
+}
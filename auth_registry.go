@@ -0,0 +1,228 @@
+package middle
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/open4go/log"
+)
+
+// Authenticator 认证步骤，失败时自行中止请求并返回 false
+// 与 gin.HandlerFunc 不同，它不会调用 c.Next()，因此可以组合使用
+type Authenticator func(c *gin.Context) bool
+
+func authMiddleware(authenticate Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authenticate(c) {
+			return
+		}
+		recordAuthOutcome(AuthSchemeOf(c), "ok")
+		c.Next()
+	}
+}
+
+// AuthScheme 路由使用的认证方式
+type AuthScheme string
+
+const (
+	// SchemePublic 无需认证
+	SchemePublic AuthScheme = "public"
+	// SchemeCookie 后台 cookie，对应 JWTMiddleware
+	SchemeCookie AuthScheme = "cookie"
+	// SchemeBearer 客户端 bearer token，对应 JWTAuthMiddleware
+	SchemeBearer AuthScheme = "bearer"
+	// SchemeWx 微信登陆 token，对应 VerifyTokenMiddleware
+	SchemeWx AuthScheme = "wx"
+	// SchemeGateway 网关签名头部，对应 MerchantBindMiddleware/SignedMerchantBindMiddleware
+	SchemeGateway AuthScheme = "gateway"
+	// SchemeService 服务间调用的身份断言，对应 IdentityAssertionMiddleware
+	SchemeService AuthScheme = "service"
+)
+
+// RouteRequirement 路由声明的认证要求
+type RouteRequirement struct {
+	Scheme AuthScheme
+	// MinLoginLevel 登陆用户等级下限，0 表示不限制
+	MinLoginLevel int
+	// Scopes 需要全部具备的 scope，只能与 SchemeBearer 一起声明
+	// 其它认证方式声明 scope 时 CheckRoutes 返回错误，请求返回 500
+	Scopes []string
+	// StepUp 需要二次验证
+	StepUp bool
+}
+
+// AuthRegistry 路由认证要求的注册表
+// 路由声明需要的认证方式，由 Middleware 统一执行，未声明的路由一律拒绝
+type AuthRegistry struct {
+	mu      sync.RWMutex
+	schemes map[AuthScheme]Authenticator
+	stepUp  Authenticator
+	routes  map[string]RouteRequirement
+}
+
+// NewAuthRegistry 创建注册表，SchemePublic 默认可用
+func NewAuthRegistry() *AuthRegistry {
+	return &AuthRegistry{
+		schemes: map[AuthScheme]Authenticator{SchemePublic: func(*gin.Context) bool { return true }},
+		routes:  map[string]RouteRequirement{},
+	}
+}
+
+// RegisterScheme 注册认证方式，例如 RegisterScheme(SchemeCookie, CookieAuthenticator(keyring))
+func (r *AuthRegistry) RegisterScheme(scheme AuthScheme, authenticate Authenticator) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemes[scheme] = authenticate
+}
+
+// SetStepUp 设置二次验证步骤，例如 SecondFactorAuthenticator(keyring)
+func (r *AuthRegistry) SetStepUp(authenticate Authenticator) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stepUp = authenticate
+}
+
+// Require 声明路由的认证要求，path 为 gin 的完整路由模板(c.FullPath())
+func (r *AuthRegistry) Require(method string, path string, req RouteRequirement) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[routeDeclKey(method, path)] = req
+}
+
+// Handle 在路由组上注册路由并同时声明认证要求，避免路径写错
+func (r *AuthRegistry) Handle(rg *gin.RouterGroup, method string, relativePath string, req RouteRequirement, handlers ...gin.HandlerFunc) {
+	r.Require(method, joinRoutePath(rg.BasePath(), relativePath), req)
+	rg.Handle(method, relativePath, handlers...)
+}
+
+// Middleware 按声明执行认证，需挂载在路由组或引擎上
+func (r *AuthRegistry) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.FullPath() == "" {
+			// 未匹配到路由，交给 gin 返回 404
+			c.Next()
+			return
+		}
+		r.mu.RLock()
+		req, ok := r.routes[routeDeclKey(c.Request.Method, c.FullPath())]
+		authenticate := r.schemes[req.Scheme]
+		stepUp := r.stepUp
+		r.mu.RUnlock()
+
+		if !ok {
+			// 未声明的路由默认拒绝，避免遗漏
+			log.Log(c.Request.Context()).WithField("path", c.FullPath()).
+				Error("route has no auth declaration")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "route has no auth declaration"})
+			return
+		}
+		if authenticate == nil {
+			log.Log(c.Request.Context()).WithField("scheme", req.Scheme).
+				Error("auth scheme is not registered")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "auth scheme is not registered"})
+			return
+		}
+		if !req.valid() {
+			log.Log(c.Request.Context()).WithField("scheme", req.Scheme).
+				Error("scopes are declared on a non-bearer route")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "scopes require bearer auth"})
+			return
+		}
+		if !authenticate(c) {
+			return
+		}
+		recordAuthOutcome(req.Scheme, "ok")
+
+		if req.MinLoginLevel > 0 {
+			l, _ := Identity(c.Request.Context())
+			level, _ := strconv.Atoi(l.LoginLevel)
+			if level < req.MinLoginLevel {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "login level is too low"})
+				return
+			}
+		}
+		if !scopesSatisfied(Scopes(c.Request.Context()), ScopeAll, req.Scopes) {
+			abortInsufficientScope(c, req.Scopes)
+			return
+		}
+		if req.StepUp {
+			if stepUp == nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "step-up is not configured"})
+				return
+			}
+			if !stepUp(c) {
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// Undeclared 返回引擎中没有声明认证要求的路由，通常在启动时调用
+func (r *AuthRegistry) Undeclared(engine *gin.Engine) []gin.RouteInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var missing []gin.RouteInfo
+	for _, route := range engine.Routes() {
+		if _, ok := r.routes[routeDeclKey(route.Method, route.Path)]; !ok {
+			missing = append(missing, route)
+		}
+	}
+	return missing
+}
+
+// valid 只有 bearer token 携带 scope
+func (req RouteRequirement) valid() bool {
+	return len(req.Scopes) == 0 || req.Scheme == SchemeBearer
+}
+
+// CheckRoutes 启动检查，存在未声明的路由或无效的声明时返回错误并列出这些路由
+func (r *AuthRegistry) CheckRoutes(engine *gin.Engine) error {
+	r.mu.RLock()
+	var invalid []string
+	for key, req := range r.routes {
+		if !req.valid() {
+			invalid = append(invalid, key)
+		}
+	}
+	r.mu.RUnlock()
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return fmt.Errorf("%w: %s", ErrInvalidRouteRequirement, strings.Join(invalid, ", "))
+	}
+
+	missing := r.Undeclared(engine)
+	if len(missing) == 0 {
+		return nil
+	}
+	list := make([]string, 0, len(missing))
+	for _, route := range missing {
+		list = append(list, route.Method+" "+route.Path)
+	}
+	sort.Strings(list)
+	return fmt.Errorf("%w: %s", ErrUndeclaredRoutes, strings.Join(list, ", "))
+}
+
+var (
+	// ErrUndeclaredRoutes 存在未声明认证要求的路由
+	ErrUndeclaredRoutes = errors.New("routes without auth declaration")
+	// ErrInvalidRouteRequirement 非 bearer 路由声明了 scope
+	ErrInvalidRouteRequirement = errors.New("scopes declared on non-bearer routes")
+)
+
+func routeDeclKey(method string, path string) string {
+	return strings.ToUpper(method) + " " + path
+}
+
+func joinRoutePath(base string, relative string) string {
+	if relative == "" {
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(relative, "/")
+}
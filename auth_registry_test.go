@@ -0,0 +1,146 @@
+package middle
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRegistryScopesRequireBearer(t *testing.T) {
+	useTestRedis(t)
+	reg := NewAuthRegistry()
+	reg.RegisterScheme(SchemeBearer, BearerAuthenticator(HMACKeyfunc(testBearerSecret), JWTAuthOptions{}))
+	reg.RegisterScheme(SchemeCookie, CookieAuthenticator(StaticKeyring([]byte("cookie-secret"))))
+
+	r := gin.New()
+	r.Use(reg.Middleware())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	reg.Handle(&r.RouterGroup, http.MethodGet, "/orders", RouteRequirement{Scheme: SchemeBearer, Scopes: []string{"orders:read"}}, ok)
+	if err := reg.CheckRoutes(r); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	for scope, want := range map[string]int{"orders:read": http.StatusOK, "profile": http.StatusForbidden} {
+		token := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": scope, "iss": "test", "aud": "app", "exp": exp, "scope": scope})
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("scope %q: status = %d, want %d", scope, w.Code, want)
+		}
+	}
+
+	reg.Handle(&r.RouterGroup, http.MethodGet, "/admin", RouteRequirement{Scheme: SchemeCookie, Scopes: []string{"admin"}}, ok)
+	if err := reg.CheckRoutes(r); !errors.Is(err, ErrInvalidRouteRequirement) {
+		t.Fatalf("err = %v, want ErrInvalidRouteRequirement", err)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("cookie route with scopes: status = %d, want 500", w.Code)
+	}
+}
+
+// levelRegistry 注册一个测试用的认证方式，登陆等级取自 X-Level 头部
+// 二次验证在带有 X-Step-Up 头部时通过
+func levelRegistry(t *testing.T) (*AuthRegistry, *gin.Engine, *int) {
+	t.Helper()
+	reg := NewAuthRegistry()
+	reg.RegisterScheme(SchemeCookie, func(c *gin.Context) bool {
+		l := LoginInfo{AccountID: "acct", LoginLevel: c.GetHeader("X-Level")}
+		c.Request = c.Request.WithContext(withIdentity(c.Request.Context(), l))
+		return true
+	})
+	stepUps := 0
+	reg.SetStepUp(func(c *gin.Context) bool {
+		stepUps++
+		if c.GetHeader("X-Step-Up") == "" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return false
+		}
+		return true
+	})
+
+	r := gin.New()
+	r.Use(reg.Middleware())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	reg.Handle(&r.RouterGroup, http.MethodGet, "/level", RouteRequirement{Scheme: SchemeCookie, MinLoginLevel: 2}, ok)
+	reg.Handle(&r.RouterGroup, http.MethodGet, "/step", RouteRequirement{Scheme: SchemeCookie, StepUp: true}, ok)
+	r.GET("/undeclared", ok)
+	return reg, r, &stepUps
+}
+
+func registryRequest(r *gin.Engine, path string, header map[string]string) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestRegistryMinLoginLevel(t *testing.T) {
+	_, r, _ := levelRegistry(t)
+	cases := []struct {
+		level string
+		want  int
+	}{
+		{"", http.StatusForbidden},
+		{"1", http.StatusForbidden},
+		{"2", http.StatusOK},
+		{"3", http.StatusOK},
+		{"abc", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		if code := registryRequest(r, "/level", map[string]string{"X-Level": tc.level}); code != tc.want {
+			t.Errorf("level %q: status = %d, want %d", tc.level, code, tc.want)
+		}
+	}
+}
+
+func TestRegistryStepUp(t *testing.T) {
+	_, r, stepUps := levelRegistry(t)
+	if code := registryRequest(r, "/step", nil); code != http.StatusUnauthorized {
+		t.Errorf("without step-up: status = %d, want 401", code)
+	}
+	if code := registryRequest(r, "/step", map[string]string{"X-Step-Up": "1"}); code != http.StatusOK {
+		t.Errorf("with step-up: status = %d, want 200", code)
+	}
+	if code := registryRequest(r, "/level", map[string]string{"X-Level": "2"}); code != http.StatusOK {
+		t.Errorf("route without step-up: status = %d, want 200", code)
+	}
+	if *stepUps != 2 {
+		t.Errorf("step-up ran %d times, want 2", *stepUps)
+	}
+
+	reg := NewAuthRegistry()
+	reg.RegisterScheme(SchemeCookie, func(*gin.Context) bool { return true })
+	unconfigured := gin.New()
+	unconfigured.Use(reg.Middleware())
+	reg.Handle(&unconfigured.RouterGroup, http.MethodGet, "/step", RouteRequirement{Scheme: SchemeCookie, StepUp: true},
+		func(c *gin.Context) { c.Status(http.StatusOK) })
+	if code := registryRequest(unconfigured, "/step", nil); code != http.StatusInternalServerError {
+		t.Errorf("step-up not configured: status = %d, want 500", code)
+	}
+}
+
+func TestRegistryUndeclaredRoute(t *testing.T) {
+	reg, r, _ := levelRegistry(t)
+	if code := registryRequest(r, "/undeclared", map[string]string{"X-Level": "3"}); code != http.StatusForbidden {
+		t.Errorf("undeclared route: status = %d, want 403", code)
+	}
+	if code := registryRequest(r, "/missing", nil); code != http.StatusNotFound {
+		t.Errorf("unknown path: status = %d, want 404", code)
+	}
+	if err := reg.CheckRoutes(r); !errors.Is(err, ErrUndeclaredRoutes) {
+		t.Errorf("err = %v, want ErrUndeclaredRoutes", err)
+	}
+}
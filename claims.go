@@ -0,0 +1,51 @@
+package middle
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// LoginClaimsVersion 当前 cookie claims 的版本
+// 版本 1(或缺省) 为历史格式：LoginInfo 以 base64 json 的形式放在 iss 中
+const LoginClaimsVersion = 2
+
+// AcceptLegacyLoginClaims 迁移期内是否接受历史格式的 cookie
+// 所有旧 cookie 过期后可以关闭
+var AcceptLegacyLoginClaims = true
+
+// LoginClaims 后台 cookie 使用的 claims
+// 标准字段(iss/exp/iat/jti...)保持原有含义，LoginInfo 的字段作为私有 claims 平铺
+type LoginClaims struct {
+	jwt.StandardClaims
+	Version int `json:"ver,omitempty"`
+	LoginInfo
+}
+
+// NewLoginClaims 根据登陆信息构建当前版本的 claims
+func NewLoginClaims(l LoginInfo, standard jwt.StandardClaims) *LoginClaims {
+	return &LoginClaims{
+		StandardClaims: standard,
+		Version:        LoginClaimsVersion,
+		LoginInfo:      l,
+	}
+}
+
+// Info 返回 claims 中的登陆信息，兼容历史格式
+func (c *LoginClaims) Info() (*LoginInfo, error) {
+	if c.Version >= LoginClaimsVersion {
+		info := c.LoginInfo
+		return &info, nil
+	}
+	if !AcceptLegacyLoginClaims {
+		return nil, errors.New("legacy login claims are no longer accepted")
+	}
+
+	// 历史格式，LoginInfo 保存在 iss 中
+	loginInfo := &LoginInfo{}
+	if err := loginInfo.Load(c.Issuer); err != nil {
+		return nil, fmt.Errorf("failed to load claims into LoginInfo: %w", err)
+	}
+	return loginInfo, nil
+}
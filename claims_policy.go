@@ -0,0 +1,185 @@
+package middle
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// JWTAuthMiddleware 返回的错误码，放在响应 json 的 code 字段中
+const (
+	AuthCodeMissingHeader   = "missing_authorization"
+	AuthCodeMalformedHeader = "malformed_authorization"
+	AuthCodeInvalidToken    = "invalid_token"
+	AuthCodeInvalidSubject  = "invalid_subject"
+	AuthCodeMissingClaim    = "missing_claim"
+	AuthCodeTokenExpired    = "token_expired"
+	AuthCodeTokenNotYet     = "token_not_yet_valid"
+	AuthCodeIssuedInFuture  = "token_issued_in_future"
+	AuthCodeTokenTooOld     = "token_too_old"
+	AuthCodeInvalidIssuer   = "invalid_issuer"
+	AuthCodeInvalidAudience = "invalid_audience"
+	AuthCodeTokenRevoked    = "token_revoked"
+	// AuthCodeTenantMismatch X-Tenant-ID 与 token 中的租户不一致，随 403 返回
+	AuthCodeTenantMismatch = "tenant_mismatch"
+	// AuthCodeIntrospectionUnavailable 内省端点出错，随 503 返回
+	AuthCodeIntrospectionUnavailable = "introspection_unavailable"
+	// AuthCodeRevocationUnavailable 无法查询吊销记录，随 503 返回
+	AuthCodeRevocationUnavailable = "revocation_unavailable"
+	// AuthCodeSessionUnavailable 无法读取登陆会话(例如微信登陆 token)，随 503 返回
+	AuthCodeSessionUnavailable = "session_unavailable"
+	// AuthCodeAuthorizationUnavailable 无法读取权限策略，随 503 返回
+	AuthCodeAuthorizationUnavailable = "authorization_unavailable"
+)
+
+// JWTAuthOptions JWTAuthMiddleware 的校验策略
+// 零值只校验签名与 exp/nbf，不限制 iss/aud
+type JWTAuthOptions struct {
+	// Issuers 允许的签发方，为空时不校验
+	Issuers []string
+	// Audience 必须出现在 aud 中（aud 可以是字符串或数组），为空时不校验
+	Audience string
+	// Leeway 校验 exp/nbf/iat 时允许的时钟偏差
+	Leeway time.Duration
+	// MaxAge 根据 iat 限制 token 的最长使用时间，0 表示不限制
+	MaxAge time.Duration
+	// RequireExpiry 为 true 时拒绝没有 exp 的 token
+	RequireExpiry bool
+	// Now 当前时间，便于测试注入，默认 time.Now
+	Now func() time.Time
+}
+
+// claimError 带错误码的校验错误
+type claimError struct {
+	code string
+	msg  string
+}
+
+func (e *claimError) Error() string {
+	return e.msg
+}
+
+func newClaimError(code string, format string, args ...interface{}) *claimError {
+	return &claimError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+func (o JWTAuthOptions) now() time.Time {
+	if o.Now != nil {
+		return o.Now()
+	}
+	return time.Now()
+}
+
+// validate 按策略校验 claims，成功时返回匹配到的 audience
+func (o JWTAuthOptions) validate(claims jwt.MapClaims) (string, *claimError) {
+	now := o.now()
+
+	exp, hasExp, err := numericClaim(claims, "exp")
+	if err != nil {
+		return "", newClaimError(AuthCodeInvalidToken, "invalid exp: %v", err)
+	}
+	if !hasExp && o.RequireExpiry {
+		return "", newClaimError(AuthCodeMissingClaim, "exp not found")
+	}
+	if hasExp && !now.Before(exp.Add(o.Leeway)) {
+		return "", newClaimError(AuthCodeTokenExpired, "token expired at %s", exp.Format(time.RFC3339))
+	}
+
+	nbf, hasNbf, err := numericClaim(claims, "nbf")
+	if err != nil {
+		return "", newClaimError(AuthCodeInvalidToken, "invalid nbf: %v", err)
+	}
+	if hasNbf && now.Add(o.Leeway).Before(nbf) {
+		return "", newClaimError(AuthCodeTokenNotYet, "token not valid before %s", nbf.Format(time.RFC3339))
+	}
+
+	iat, hasIat, err := numericClaim(claims, "iat")
+	if err != nil {
+		return "", newClaimError(AuthCodeInvalidToken, "invalid iat: %v", err)
+	}
+	if hasIat && now.Add(o.Leeway).Before(iat) {
+		return "", newClaimError(AuthCodeIssuedInFuture, "token issued in the future at %s", iat.Format(time.RFC3339))
+	}
+	if o.MaxAge > 0 {
+		if !hasIat {
+			return "", newClaimError(AuthCodeMissingClaim, "iat not found")
+		}
+		if now.Sub(iat) > o.MaxAge+o.Leeway {
+			return "", newClaimError(AuthCodeTokenTooOld, "token issued at %s exceeds max age %s",
+				iat.Format(time.RFC3339), o.MaxAge)
+		}
+	}
+
+	iss, ok := claims["iss"].(string)
+	if !ok {
+		return "", newClaimError(AuthCodeMissingClaim, "iss not found")
+	}
+	if len(o.Issuers) > 0 && !containsString(o.Issuers, iss) {
+		return "", newClaimError(AuthCodeInvalidIssuer, "issuer %q is not accepted", iss)
+	}
+
+	auds, ok := audienceClaim(claims["aud"])
+	if !ok {
+		return "", newClaimError(AuthCodeMissingClaim, "aud not found")
+	}
+	if o.Audience == "" {
+		return auds[0], nil
+	}
+	if !containsString(auds, o.Audience) {
+		return "", newClaimError(AuthCodeInvalidAudience, "audience %q not found in token", o.Audience)
+	}
+	return o.Audience, nil
+}
+
+// numericClaim 读取 NumericDate 类型的 claim
+func numericClaim(claims jwt.MapClaims, name string) (time.Time, bool, error) {
+	v, ok := claims[name]
+	if !ok || v == nil {
+		return time.Time{}, false, nil
+	}
+	switch n := v.(type) {
+	case float64:
+		return time.Unix(int64(n), 0), true, nil
+	case json.Number:
+		i, err := n.Int64()
+		if err != nil {
+			f, ferr := n.Float64()
+			if ferr != nil {
+				return time.Time{}, false, err
+			}
+			i = int64(f)
+		}
+		return time.Unix(i, 0), true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("unexpected type %T", v)
+}
+
+// audienceClaim aud 既可以是字符串也可以是字符串数组
+func audienceClaim(v interface{}) ([]string, bool) {
+	switch aud := v.(type) {
+	case string:
+		return []string{aud}, true
+	case []interface{}:
+		auds := make([]string, 0, len(aud))
+		for _, item := range aud {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			auds = append(auds, s)
+		}
+		return auds, len(auds) > 0
+	}
+	return nil, false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package middle
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestJWTAuthOptionsValidate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	at := func(d time.Duration) float64 { return float64(now.Add(d).Unix()) }
+	claims := func(extra jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{"iss": "idp", "aud": "app", "exp": at(time.Hour)}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+	base := JWTAuthOptions{Now: func() time.Time { return now }}
+	with := func(f func(o *JWTAuthOptions)) JWTAuthOptions {
+		o := base
+		f(&o)
+		return o
+	}
+	leeway := with(func(o *JWTAuthOptions) { o.Leeway = 30 * time.Second })
+
+	cases := []struct {
+		name    string
+		opts    JWTAuthOptions
+		claims  jwt.MapClaims
+		code    string
+		wantAud string
+	}{
+		{"valid", base, claims(nil), "", "app"},
+		{"expired", base, claims(jwt.MapClaims{"exp": at(-time.Second)}), AuthCodeTokenExpired, ""},
+		{"expires now", base, claims(jwt.MapClaims{"exp": at(0)}), AuthCodeTokenExpired, ""},
+		{"expired inside leeway", leeway, claims(jwt.MapClaims{"exp": at(-29 * time.Second)}), "", "app"},
+		{"expired at leeway edge", leeway, claims(jwt.MapClaims{"exp": at(-30 * time.Second)}), AuthCodeTokenExpired, ""},
+		{"missing exp allowed", base, claims(jwt.MapClaims{"exp": nil}), "", "app"},
+		{"missing exp required", with(func(o *JWTAuthOptions) { o.RequireExpiry = true }),
+			claims(jwt.MapClaims{"exp": nil}), AuthCodeMissingClaim, ""},
+		{"not yet valid", base, claims(jwt.MapClaims{"nbf": at(time.Second)}), AuthCodeTokenNotYet, ""},
+		{"nbf at leeway edge", leeway, claims(jwt.MapClaims{"nbf": at(30 * time.Second)}), "", "app"},
+		{"nbf beyond leeway", leeway, claims(jwt.MapClaims{"nbf": at(31 * time.Second)}), AuthCodeTokenNotYet, ""},
+		{"issued in future", base, claims(jwt.MapClaims{"iat": at(time.Second)}), AuthCodeIssuedInFuture, ""},
+		{"iat at leeway edge", leeway, claims(jwt.MapClaims{"iat": at(30 * time.Second)}), "", "app"},
+		{"iat beyond leeway", leeway, claims(jwt.MapClaims{"iat": at(31 * time.Second)}), AuthCodeIssuedInFuture, ""},
+		{"max age", with(func(o *JWTAuthOptions) { o.MaxAge = time.Hour }),
+			claims(jwt.MapClaims{"iat": at(-time.Hour)}), "", "app"},
+		{"max age exceeded", with(func(o *JWTAuthOptions) { o.MaxAge = time.Hour }),
+			claims(jwt.MapClaims{"iat": at(-time.Hour - time.Second)}), AuthCodeTokenTooOld, ""},
+		{"max age exceeded inside leeway", with(func(o *JWTAuthOptions) { o.MaxAge = time.Hour; o.Leeway = time.Second }),
+			claims(jwt.MapClaims{"iat": at(-time.Hour - time.Second)}), "", "app"},
+		{"max age without iat", with(func(o *JWTAuthOptions) { o.MaxAge = time.Hour }),
+			claims(nil), AuthCodeMissingClaim, ""},
+		{"issuer allowed", with(func(o *JWTAuthOptions) { o.Issuers = []string{"other", "idp"} }), claims(nil), "", "app"},
+		{"issuer not allowed", with(func(o *JWTAuthOptions) { o.Issuers = []string{"other"} }), claims(nil), AuthCodeInvalidIssuer, ""},
+		{"missing issuer", base, claims(jwt.MapClaims{"iss": nil}), AuthCodeMissingClaim, ""},
+		{"audience string", with(func(o *JWTAuthOptions) { o.Audience = "app" }), claims(nil), "", "app"},
+		{"audience string mismatch", with(func(o *JWTAuthOptions) { o.Audience = "api" }), claims(nil), AuthCodeInvalidAudience, ""},
+		{"audience array", with(func(o *JWTAuthOptions) { o.Audience = "api" }),
+			claims(jwt.MapClaims{"aud": []interface{}{"app", "api"}}), "", "api"},
+		{"audience array mismatch", with(func(o *JWTAuthOptions) { o.Audience = "web" }),
+			claims(jwt.MapClaims{"aud": []interface{}{"app", "api"}}), AuthCodeInvalidAudience, ""},
+		{"audience array first", base, claims(jwt.MapClaims{"aud": []interface{}{"app", "api"}}), "", "app"},
+		{"missing audience", base, claims(jwt.MapClaims{"aud": nil}), AuthCodeMissingClaim, ""},
+		{"invalid exp", base, claims(jwt.MapClaims{"exp": "tomorrow"}), AuthCodeInvalidToken, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			aud, err := tc.opts.validate(tc.claims)
+			code := ""
+			if err != nil {
+				code = err.code
+			}
+			if code != tc.code {
+				t.Fatalf("code = %q (%v), want %q", code, err, tc.code)
+			}
+			if err == nil && aud != tc.wantAud {
+				t.Fatalf("aud = %q, want %q", aud, tc.wantAud)
+			}
+		})
+	}
+}
+
+func TestJWTAuthOptionsRejectsFutureIatOverHTTP(t *testing.T) {
+	useTestRedis(t)
+	now := time.Now()
+	token := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": "j", "iss": "test", "aud": "app",
+		"iat": now.Add(time.Hour).Unix(), "exp": now.Add(2 * time.Hour).Unix()})
+	code, reason := bearerRequest(t, JWTAuthMiddleware(testBearerSecret), token, nil)
+	if code != http.StatusUnauthorized || reason != AuthCodeIssuedInFuture {
+		t.Fatalf("got %d %q, want 401 %q", code, reason, AuthCodeIssuedInFuture)
+	}
+}
@@ -0,0 +1,102 @@
+package middle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+func legacyCookieToken(t *testing.T, secret []byte, l LoginInfo) string {
+	t.Helper()
+	// 历史格式：LoginInfo 以 base64 json 放在 iss 中，没有 ver 与 kid
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Issuer:    DumpLoginInfo(l),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	s, err := token.SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func cookieLoginInfo(t *testing.T, keyring *Keyring, token string) (*LoginInfo, error) {
+	t.Helper()
+	parsed, err := parseJWTToken(token, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return extractClaims(parsed)
+}
+
+func TestLoginClaimsRoundTrip(t *testing.T) {
+	keyring := StaticKeyring([]byte("cookie-secret"))
+	want := LoginInfo{MerchantID: "m1", AccountID: "acct", UserName: "alice", LoginLevel: "2"}
+	token, _, err := (&Issuer{Name: "idp", Keyring: keyring}).IssueCookieToken(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := cookieLoginInfo(t, keyring, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != want {
+		t.Fatalf("login info = %+v, want %+v", *got, want)
+	}
+
+	parsed, _ := parseJWTToken(token, keyring)
+	if claims := parsed.Claims.(*LoginClaims); claims.Version != LoginClaimsVersion || claims.Issuer != "idp" {
+		t.Fatalf("claims = %+v", claims)
+	}
+}
+
+func TestLoginClaimsLegacyFormat(t *testing.T) {
+	secret := []byte("cookie-secret")
+	keyring := StaticKeyring(secret)
+	want := LoginInfo{MerchantID: "m1", AccountID: "acct", UserName: "alice"}
+	token := legacyCookieToken(t, secret, want)
+
+	got, err := cookieLoginInfo(t, keyring, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != want {
+		t.Fatalf("login info = %+v, want %+v", *got, want)
+	}
+
+	useTestRedis(t)
+	r := gin.New()
+	r.GET("/res", JWTMiddleware(secret), func(c *gin.Context) { c.Status(http.StatusOK) })
+	request := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/res", nil)
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: token})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := request(); code != http.StatusOK {
+		t.Fatalf("legacy cookie status = %d, want 200", code)
+	}
+
+	AcceptLegacyLoginClaims = false
+	t.Cleanup(func() { AcceptLegacyLoginClaims = true })
+	if _, err := cookieLoginInfo(t, keyring, token); err == nil {
+		t.Fatal("legacy claims accepted after toggle")
+	}
+	if code := request(); code != http.StatusUnauthorized {
+		t.Fatalf("legacy cookie status = %d, want 401", code)
+	}
+
+	// 当前格式不受开关影响
+	current, _, err := (&Issuer{Keyring: keyring}).IssueCookieToken(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cookieLoginInfo(t, keyring, current); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,170 @@
+package middle
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// RequestIDHeader 请求 id，入站时接受，出站时回写
+	RequestIDHeader = "X-Request-ID"
+	// TraceparentHeader W3C trace context
+	TraceparentHeader = "traceparent"
+	// LegacyTraceIDKey open4go/log 读取的上下文 key
+	LegacyTraceIDKey = "traceid"
+	// LegacyClientIPKey open4go/log 读取的上下文 key
+	LegacyClientIPKey = "ip"
+)
+
+// requestIDMaxLength 入站 X-Request-ID 的长度上限，超过时重新生成
+const requestIDMaxLength = 128
+
+type correlationKey struct{}
+
+// TraceContext 入站 traceparent 解析结果
+type TraceContext struct {
+	// TraceID 32 位十六进制
+	TraceID string
+	// ParentID 上游 span id，16 位十六进制
+	ParentID string
+	// Flags 例如 01 表示已采样
+	Flags string
+}
+
+// correlation 请求唯一的关联 id
+type correlation struct {
+	id    string
+	trace TraceContext
+	// generated id 为本地随机生成，之后创建的 span 可以替换它
+	generated bool
+}
+
+// RequestID 返回请求的关联 id，未经过 CorrelationMiddleware 时为空
+func RequestID(ctx context.Context) string {
+	if v, ok := ctx.Value(correlationKey{}).(correlation); ok {
+		return v.id
+	}
+	return ""
+}
+
+// InboundTraceContext 返回入站的 traceparent，没有或格式错误时 ok 为 false
+func InboundTraceContext(ctx context.Context) (TraceContext, bool) {
+	v, ok := ctx.Value(correlationKey{}).(correlation)
+	if !ok || v.trace.TraceID == "" {
+		return TraceContext{}, false
+	}
+	return v.trace, true
+}
+
+// CorrelationMiddleware 为请求分配唯一的关联 id
+// 优先使用入站 traceparent 的 trace id，其次是 X-Request-ID，再其次是当前 span 的 trace id，都没有时生成新的 id
+// id 写入上下文并在响应头 X-Request-ID 中返回，open4go/log 会自动带上
+func CorrelationMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bindCorrelation(c)
+		c.Next()
+	}
+}
+
+// bindCorrelation 已经绑定过时直接返回，CORSMiddleware 与 TraceMiddleware 可以同时使用
+// 之前生成的 id 在 TracingMiddleware 创建 span 后改用 span 的 trace id，保证两者一致
+func bindCorrelation(c *gin.Context) string {
+	ctx := c.Request.Context()
+	span := trace.SpanContextFromContext(ctx)
+	if v, ok := ctx.Value(correlationKey{}).(correlation); ok {
+		if !v.generated || !span.IsValid() {
+			return v.id
+		}
+		return storeCorrelation(c, correlation{id: span.TraceID().String()})
+	}
+
+	v := correlation{}
+	if tc, ok := parseTraceparent(c.GetHeader(TraceparentHeader)); ok {
+		v.trace = tc
+		v.id = tc.TraceID
+	} else if id := c.GetHeader(RequestIDHeader); validRequestID(id) {
+		v.id = id
+	} else if span.IsValid() {
+		v.id = span.TraceID().String()
+	} else {
+		v.id = newTraceID()
+		v.generated = true
+	}
+	return storeCorrelation(c, v)
+}
+
+// storeCorrelation 写入上下文、gin 上下文与响应头
+func storeCorrelation(c *gin.Context, v correlation) string {
+	ctx := context.WithValue(c.Request.Context(), correlationKey{}, v)
+	ctx = context.WithValue(ctx, LegacyTraceIDKey, v.id)
+	ctx = context.WithValue(ctx, LegacyClientIPKey, c.ClientIP())
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Set("RequestID", v.id)
+	c.Header(RequestIDHeader, v.id)
+	return v.id
+}
+
+// parseTraceparent 解析 version-traceid-parentid-flags
+func parseTraceparent(s string) (TraceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 {
+		return TraceContext{}, false
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	// 版本 00 只能有 4 段，未知的更高版本按前 4 段解析
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return TraceContext{}, false
+	}
+	if !isLowerHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return TraceContext{}, false
+	}
+	if !isLowerHex(parentID, 16) || parentID == strings.Repeat("0", 16) {
+		return TraceContext{}, false
+	}
+	if !isLowerHex(flags, 2) {
+		return TraceContext{}, false
+	}
+	return TraceContext{TraceID: traceID, ParentID: parentID, Flags: flags}, true
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= '0' && s[i] <= '9' || s[i] >= 'a' && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// validRequestID 只接受可安全写入日志与响应头的字符
+func validRequestID(id string) bool {
+	if id == "" || len(id) > requestIDMaxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		ch := id[i]
+		if !(ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// newTraceID 16 字节随机数，与 W3C trace id 格式相同
+func newTraceID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
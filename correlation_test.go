@@ -0,0 +1,138 @@
+package middle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+func TestParseTraceparent(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"valid", "00-" + testTraceID + "-00f067aa0ba902b7-01", true},
+		{"surrounding space", " 00-" + testTraceID + "-00f067aa0ba902b7-01 ", true},
+		{"future version with extra field", "01-" + testTraceID + "-00f067aa0ba902b7-01-extra", true},
+		{"empty", "", false},
+		{"too few fields", "00-" + testTraceID + "-00f067aa0ba902b7", false},
+		{"version 00 with extra field", "00-" + testTraceID + "-00f067aa0ba902b7-01-extra", false},
+		{"version ff", "ff-" + testTraceID + "-00f067aa0ba902b7-01", false},
+		{"short trace id", "00-4bf92f3577b34da6-00f067aa0ba902b7-01", false},
+		{"all-zero trace id", "00-" + strings.Repeat("0", 32) + "-00f067aa0ba902b7-01", false},
+		{"all-zero parent id", "00-" + testTraceID + "-" + strings.Repeat("0", 16) + "-01", false},
+		{"upper-case trace id", "00-" + strings.ToUpper(testTraceID) + "-00f067aa0ba902b7-01", false},
+		{"upper-case parent id", "00-" + testTraceID + "-00F067AA0BA902B7-01", false},
+		{"non-hex flags", "00-" + testTraceID + "-00f067aa0ba902b7-zz", false},
+	}
+	for _, tc := range cases {
+		got, ok := parseTraceparent(tc.header)
+		if ok != tc.ok {
+			t.Errorf("%s: ok = %v, want %v", tc.name, ok, tc.ok)
+			continue
+		}
+		if ok && (got.TraceID != testTraceID || got.ParentID != "00f067aa0ba902b7" || got.Flags != "01") {
+			t.Errorf("%s: got %+v", tc.name, got)
+		}
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	cases := []struct {
+		id   string
+		want bool
+	}{
+		{"req-123_abc.def:1", true},
+		{strings.Repeat("a", requestIDMaxLength), true},
+		{"", false},
+		{strings.Repeat("a", requestIDMaxLength+1), false},
+		{"id\r\nSet-Cookie: x=1", false},
+		{"id\nlevel=error", false},
+		{"id with space", false},
+		{`id"quoted`, false},
+		{"id<script>", false},
+		{"ид", false},
+	}
+	for _, tc := range cases {
+		if got := validRequestID(tc.id); got != tc.want {
+			t.Errorf("validRequestID(%q) = %v, want %v", tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestCorrelationMiddleware(t *testing.T) {
+	traceparent := "00-" + testTraceID + "-00f067aa0ba902b7-01"
+	cases := []struct {
+		name        string
+		traceparent string
+		requestID   string
+		want        string
+	}{
+		{"traceparent wins over request id", traceparent, "req-1", testTraceID},
+		{"request id only", "", "req-1", "req-1"},
+		{"malformed traceparent falls back to request id", "00-bad-00f067aa0ba902b7-01", "req-1", "req-1"},
+		{"injected request id is replaced", "", "req\r\nx: y", ""},
+		{"no headers", "", "", ""},
+	}
+	for _, tc := range cases {
+		var id, legacyID, legacyIP string
+		var inbound bool
+		r := gin.New()
+		r.GET("/res", CorrelationMiddleware(), func(c *gin.Context) {
+			ctx := c.Request.Context()
+			id = RequestID(ctx)
+			legacyID, _ = ctx.Value(LegacyTraceIDKey).(string)
+			legacyIP, _ = ctx.Value(LegacyClientIPKey).(string)
+			_, inbound = InboundTraceContext(ctx)
+			c.Status(http.StatusOK)
+		})
+		req := httptest.NewRequest(http.MethodGet, "/res", nil)
+		if tc.traceparent != "" {
+			req.Header.Set(TraceparentHeader, tc.traceparent)
+		}
+		if tc.requestID != "" {
+			req.Header.Set(RequestIDHeader, tc.requestID)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if tc.want != "" && id != tc.want {
+			t.Errorf("%s: RequestID = %q, want %q", tc.name, id, tc.want)
+		}
+		if tc.want == "" && !isLowerHex(id, 32) {
+			t.Errorf("%s: generated RequestID = %q, want 32 hex characters", tc.name, id)
+		}
+		if got := w.Header().Get(RequestIDHeader); got != id {
+			t.Errorf("%s: response %s = %q, want %q", tc.name, RequestIDHeader, got, id)
+		}
+		if legacyID != id {
+			t.Errorf("%s: %s = %q, want %q", tc.name, LegacyTraceIDKey, legacyID, id)
+		}
+		if legacyIP != "192.0.2.1" {
+			t.Errorf("%s: %s = %q, want 192.0.2.1", tc.name, LegacyClientIPKey, legacyIP)
+		}
+		if inbound != (id == testTraceID) {
+			t.Errorf("%s: InboundTraceContext ok = %v", tc.name, inbound)
+		}
+	}
+}
+
+func TestBindCorrelationOnce(t *testing.T) {
+	var first, second string
+	r := gin.New()
+	r.GET("/res", func(c *gin.Context) {
+		first = bindCorrelation(c)
+		second = bindCorrelation(c)
+		c.Status(http.StatusOK)
+	})
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/res", nil))
+	if first == "" || first != second {
+		t.Fatalf("ids = %q, %q, want the same non-empty id", first, second)
+	}
+}
@@ -2,32 +2,30 @@ package middle
 
 import (
 	"context"
-	"encoding/hex"
 	"github.com/gin-gonic/gin"
 	"github.com/open4go/model"
 	"github.com/spf13/viper"
-	"math/rand"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// CORSMiddleware 跨站请求
+// CORSMiddleware 跨站请求，固定返回 host 作为允许的来源
+// 需要多个来源或通配子域名时使用 CORSPolicy
 func CORSMiddleware(host string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// 跨站请求必要的header
 		c.Writer.Header().Set("Access-Control-Allow-Origin", host)
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, Merchant-Id, jwt, User-Id, Content-Range, X-Total-Count, Token")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
-		c.Writer.Header().Set("Access-Control-Expose-Headers", "Content-Range,X-Total-Count")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", strings.Join(DefaultCORSHeaders, ", "))
+		c.Writer.Header().Set("Access-Control-Allow-Methods", strings.Join(DefaultCORSMethods, ", "))
+		c.Writer.Header().Set("Access-Control-Expose-Headers", strings.Join(DefaultCORSExposeHeaders, ","))
+		c.Writer.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(DefaultCORSMaxAge/time.Second)))
+		c.Writer.Header().Add("Vary", "Origin")
 
 		// 添加必要的信息便于日志追踪
-		traceID := generateTraceID()
-		ctx := context.WithValue(c.Request.Context(), "traceid", traceID)
-		ip := c.ClientIP()
-		ctx = context.WithValue(ctx, "ip", ip)
-
-		// 更新请求上下文
-		c.Request = c.Request.WithContext(ctx)
+		bindCorrelation(c)
+		ctx := c.Request.Context()
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -47,11 +45,3 @@ func CORSMiddleware(host string) gin.HandlerFunc {
 		c.Next()
 	}
 }
-
-func generateTraceID() string {
-	b := make([]byte, 16)
-	if _, err := rand.Read(b); err != nil {
-		return ""
-	}
-	return hex.EncodeToString(b)
-}
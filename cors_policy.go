@@ -0,0 +1,278 @@
+package middle
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 默认允许的方法与头部
+var (
+	DefaultCORSMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	DefaultCORSHeaders = []string{
+		"Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization", "accept", "origin",
+		"Cache-Control", "X-Requested-With", "Merchant-Id", "jwt", "User-Id", "Content-Range", "X-Total-Count", "Token",
+		"X-Tenant-ID", "X-Request-ID", "X-TOTP-Code", "X-Recovery-Code",
+	}
+	DefaultCORSExposeHeaders = []string{"Content-Range", "X-Total-Count"}
+	// DefaultCORSMaxAge 预检结果的缓存时间
+	DefaultCORSMaxAge = 10 * time.Minute
+)
+
+// CORSPolicy 跨站请求策略
+// 只有匹配 AllowOrigins 的 Origin 才会被回显，其它来源不返回 CORS 头部
+type CORSPolicy struct {
+	// AllowOrigins 允许的来源，支持
+	//   精确匹配 https://admin.example.com
+	//   子域名通配 https://*.shop.example.com 或 *.shop.example.com(不限协议)，不匹配 shop.example.com 本身
+	//   "*" 任意来源，固定返回 *，此时不会返回 Access-Control-Allow-Credentials
+	AllowOrigins  []string `mapstructure:"origins"`
+	AllowMethods  []string `mapstructure:"methods"`
+	AllowHeaders  []string `mapstructure:"headers"`
+	ExposeHeaders []string `mapstructure:"expose_headers"`
+	// AllowCredentials 允许携带 cookie，AllowOrigins 包含 "*" 时不生效
+	AllowCredentials bool          `mapstructure:"allow_credentials"`
+	MaxAge           time.Duration `mapstructure:"max_age"`
+}
+
+// NewCORSPolicy 使用默认的方法、头部与预检缓存时间创建策略
+// 允许携带 cookie，origins 包含 "*" 时除外
+func NewCORSPolicy(origins ...string) CORSPolicy {
+	return CORSPolicy{
+		AllowOrigins:     origins,
+		AllowMethods:     DefaultCORSMethods,
+		AllowHeaders:     DefaultCORSHeaders,
+		ExposeHeaders:    DefaultCORSExposeHeaders,
+		AllowCredentials: !containsString(origins, "*"),
+		MaxAge:           DefaultCORSMaxAge,
+	}
+}
+
+// WithMethods 返回使用指定方法的副本，用于路由组
+func (p CORSPolicy) WithMethods(methods ...string) CORSPolicy {
+	p.AllowMethods = methods
+	return p
+}
+
+// WithHeaders 返回使用指定头部的副本，用于路由组
+func (p CORSPolicy) WithHeaders(headers ...string) CORSPolicy {
+	p.AllowHeaders = headers
+	return p
+}
+
+// WithMaxAge 返回使用指定预检缓存时间的副本，用于路由组
+func (p CORSPolicy) WithMaxAge(maxAge time.Duration) CORSPolicy {
+	p.MaxAge = maxAge
+	return p
+}
+
+// AllowOrigin 判断来源是否被允许
+func (p CORSPolicy) AllowOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	for _, pattern := range p.AllowOrigins {
+		if matchOrigin(pattern, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin 通配符只能出现在最左侧的标签
+func matchOrigin(pattern string, origin *url.URL) bool {
+	if pattern == "*" {
+		return true
+	}
+	host := pattern
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if !strings.EqualFold(pattern[:i], origin.Scheme) {
+			return false
+		}
+		host = pattern[i+3:]
+	} else if !strings.HasPrefix(pattern, "*.") {
+		// 精确匹配需要带协议
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "/"))
+	target := strings.ToLower(origin.Host)
+	if strings.HasPrefix(host, "*.") {
+		suffix := host[1:]
+		return strings.HasSuffix(target, suffix) && len(target) > len(suffix)
+	}
+	return host == target
+}
+
+// Middleware 按策略处理跨站请求，预检请求在这里直接返回
+func (p CORSPolicy) Middleware() gin.HandlerFunc {
+	methods := strings.Join(p.AllowMethods, ", ")
+	headers := strings.Join(p.AllowHeaders, ", ")
+	expose := strings.Join(p.ExposeHeaders, ", ")
+	return func(c *gin.Context) {
+		p.apply(c, methods, headers, expose)
+	}
+}
+
+func (p CORSPolicy) apply(c *gin.Context, methods string, headers string, expose string) {
+	h := c.Writer.Header()
+	// 响应内容随 Origin 变化，避免缓存串用
+	h.Add("Vary", "Origin")
+	origin := c.GetHeader("Origin")
+	preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+	if preflight {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+
+	if origin == "" {
+		c.Next()
+		return
+	}
+	if !p.AllowOrigin(origin) {
+		if preflight {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		// 非预检请求交给浏览器拦截，同源请求也可能携带 Origin
+		c.Next()
+		return
+	}
+
+	if p.allowAny() {
+		// 任意来源不能携带 cookie，否则任何站点都能以用户身份读取响应
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		if p.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+	if expose != "" {
+		h.Set("Access-Control-Expose-Headers", expose)
+	}
+
+	if preflight {
+		h.Set("Access-Control-Allow-Methods", methods)
+		h.Set("Access-Control-Allow-Headers", headers)
+		if p.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge/time.Second)))
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+		return
+	}
+	c.Next()
+}
+
+func (p CORSPolicy) allowAny() bool {
+	return containsString(p.AllowOrigins, "*")
+}
+
+// CORSPolicies 按路径前缀选择策略，需挂载在引擎上
+// 预检请求通常没有对应的 OPTIONS 路由，挂载在路由组上时不会被执行
+type CORSPolicies struct {
+	mu       sync.RWMutex
+	Default  CORSPolicy
+	prefixes []string
+	routes   map[string]CORSPolicy
+}
+
+// NewCORSPolicies 创建策略集合，未匹配任何前缀时使用 def
+func NewCORSPolicies(def CORSPolicy) *CORSPolicies {
+	return &CORSPolicies{Default: def, routes: map[string]CORSPolicy{}}
+}
+
+// Route 为路径前缀(通常是路由组的 BasePath)设置策略，最长前缀优先
+func (s *CORSPolicies) Route(prefix string, p CORSPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix = "/" + strings.Trim(prefix, "/")
+	if _, ok := s.routes[prefix]; !ok {
+		s.prefixes = append(s.prefixes, prefix)
+		sort.Slice(s.prefixes, func(i, j int) bool { return len(s.prefixes[i]) > len(s.prefixes[j]) })
+	}
+	s.routes[prefix] = p
+}
+
+// Policy 返回路径对应的策略
+func (s *CORSPolicies) Policy(path string) CORSPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, prefix := range s.prefixes {
+		if prefix == "/" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return s.routes[prefix]
+		}
+	}
+	return s.Default
+}
+
+// Middleware 按请求路径执行对应的策略
+func (s *CORSPolicies) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p := s.Policy(c.Request.URL.Path)
+		p.apply(c, strings.Join(p.AllowMethods, ", "), strings.Join(p.AllowHeaders, ", "), strings.Join(p.ExposeHeaders, ", "))
+	}
+}
+
+// LoadCORSPoliciesFromViper 从 viper 读取策略，例如
+//
+//	cors:
+//	  origins: ["https://admin.example.com", "https://*.shop.example.com"]
+//	  max_age: 10m
+//	  routes:
+//	    /v1/open:
+//	      methods: ["GET"]
+//	      allow_credentials: false
+//
+// 顶层未配置的字段使用默认值，路由中未配置的字段继承顶层配置
+// 路由前缀中不能包含 "."，viper 会将其作为层级分隔符
+func LoadCORSPoliciesFromViper(key string) (*CORSPolicies, error) {
+	def, err := loadCORSPolicy(key, NewCORSPolicy())
+	if err != nil {
+		return nil, err
+	}
+	set := NewCORSPolicies(def)
+	for prefix := range viper.GetStringMap(key + ".routes") {
+		p, err := loadCORSPolicy(key+".routes."+prefix, def)
+		if err != nil {
+			return nil, err
+		}
+		set.Route(prefix, p)
+	}
+	return set, nil
+}
+
+// loadCORSPolicy 读取 key 下的策略，未配置的字段取自 base
+func loadCORSPolicy(key string, base CORSPolicy) (CORSPolicy, error) {
+	// 解码到空结构，避免复用 base 中的切片
+	var p CORSPolicy
+	if err := viper.UnmarshalKey(key, &p); err != nil {
+		return p, err
+	}
+	if len(p.AllowOrigins) == 0 {
+		p.AllowOrigins = base.AllowOrigins
+	}
+	if len(p.AllowMethods) == 0 {
+		p.AllowMethods = base.AllowMethods
+	}
+	if len(p.AllowHeaders) == 0 {
+		p.AllowHeaders = base.AllowHeaders
+	}
+	if len(p.ExposeHeaders) == 0 {
+		p.ExposeHeaders = base.ExposeHeaders
+	}
+	if !viper.IsSet(key + ".allow_credentials") {
+		p.AllowCredentials = base.AllowCredentials
+	}
+	if !viper.IsSet(key + ".max_age") {
+		p.MaxAge = base.MaxAge
+	}
+	return p, nil
+}
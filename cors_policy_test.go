@@ -0,0 +1,53 @@
+package middle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func corsRequest(t *testing.T, p CORSPolicy, origin string) http.Header {
+	t.Helper()
+	r := gin.New()
+	r.Use(p.Middleware())
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", origin)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Header()
+}
+
+func TestCORSPolicyWildcardNeverSendsCredentials(t *testing.T) {
+	p := NewCORSPolicy("*")
+	if p.AllowCredentials {
+		t.Fatal("wildcard policy should not allow credentials")
+	}
+	// 手动开启 credentials 时同样返回 *，不回显来源
+	p.AllowCredentials = true
+	h := corsRequest(t, p, "https://evil.example.com")
+	if got := h.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Fatalf("allow origin = %q, want *", got)
+	}
+	if got := h.Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Fatalf("allow credentials = %q, want empty", got)
+	}
+}
+
+func TestCORSPolicyEchoesListedOrigin(t *testing.T) {
+	p := NewCORSPolicy("https://*.shop.example.com")
+	h := corsRequest(t, p, "https://a.shop.example.com")
+	if got := h.Get("Access-Control-Allow-Origin"); got != "https://a.shop.example.com" {
+		t.Fatalf("allow origin = %q", got)
+	}
+	if got := h.Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Fatalf("allow credentials = %q, want true", got)
+	}
+
+	h = corsRequest(t, p, "https://shop.example.com")
+	if got := h.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Fatalf("allow origin = %q, want empty", got)
+	}
+}
@@ -0,0 +1,111 @@
+package middle
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	GatewayTimestampHeader = "X-Gateway-Timestamp"
+	GatewayNonceHeader     = "X-Gateway-Nonce"
+	GatewaySignatureHeader = "X-Gateway-Signature"
+	// GatewayNonceKeyPrefix 已使用的 nonce，用于防重放
+	GatewayNonceKeyPrefix = "gateway:nonce:"
+)
+
+// GatewaySignatureMaxSkew 签名时间戳与本机时间允许的最大偏差
+var GatewaySignatureMaxSkew = 5 * time.Minute
+
+var (
+	ErrGatewaySignatureMissing = errors.New("gateway signature is missing")
+	ErrGatewaySignatureInvalid = errors.New("gateway signature is invalid")
+	ErrGatewaySignatureStale   = errors.New("gateway signature is stale")
+	ErrGatewayNonceReplayed    = errors.New("gateway nonce has already been used")
+)
+
+// gatewaySignedHeaders 参与签名的头部，包含身份头部以及绑定商户用到的头部
+func gatewaySignedHeaders() []string {
+	return append(append([]string{}, IdentityHeaders...), "X-Tenant-ID", "X-Merchant-ID")
+}
+
+// SignGatewayHeaders 网关转发前调用，为身份头部加上时间戳、nonce 与签名
+func SignGatewayHeaders(req *http.Request, secret []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := uuid.New().String()
+	req.Header.Set(GatewayTimestampHeader, timestamp)
+	req.Header.Set(GatewayNonceHeader, nonce)
+	req.Header.Set(GatewaySignatureHeader, gatewaySignature(req, secret, timestamp, nonce))
+}
+
+// VerifyGatewayHeaders 校验网关签名，签名过期或 nonce 重复使用均视为失败
+func VerifyGatewayHeaders(ctx context.Context, req *http.Request, secret []byte) error {
+	timestamp := req.Header.Get(GatewayTimestampHeader)
+	nonce := req.Header.Get(GatewayNonceHeader)
+	signature := req.Header.Get(GatewaySignatureHeader)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return ErrGatewaySignatureMissing
+	}
+
+	expected := gatewaySignature(req, secret, timestamp, nonce)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return ErrGatewaySignatureInvalid
+	}
+
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrGatewaySignatureInvalid
+	}
+	skew := time.Since(time.Unix(sec, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > GatewaySignatureMaxSkew {
+		return ErrGatewaySignatureStale
+	}
+
+	// nonce 只需保留到签名过期为止
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return err
+	}
+	ok, err := handler.SetNX(ctx, GatewayNonceKeyPrefix+nonce, timestamp, 2*GatewaySignatureMaxSkew).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrGatewayNonceReplayed
+	}
+	return nil
+}
+
+// gatewaySignature 对 时间戳/nonce/方法/路径/头部 计算 HMAC-SHA256
+func gatewaySignature(req *http.Request, secret []byte, timestamp string, nonce string) string {
+	var b strings.Builder
+	b.WriteString(timestamp)
+	b.WriteByte('\n')
+	b.WriteString(nonce)
+	b.WriteByte('\n')
+	b.WriteString(req.Method)
+	b.WriteByte('\n')
+	b.WriteString(req.URL.Path)
+	b.WriteByte('\n')
+	for _, h := range gatewaySignedHeaders() {
+		b.WriteString(strings.ToLower(h))
+		b.WriteByte(':')
+		b.WriteString(req.Header.Get(h))
+		b.WriteByte('\n')
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(b.String()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,53 @@
+package middle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func gatewayRequest(t *testing.T, h gin.HandlerFunc, sign []byte) (int, LoginInfo) {
+	t.Helper()
+	var l LoginInfo
+	r := gin.New()
+	r.GET("/res", h, func(c *gin.Context) { l, _ = Identity(c.Request.Context()) })
+	req := httptest.NewRequest(http.MethodGet, "/res", nil)
+	req.Header.Set("AccountID", "acct")
+	req.Header.Set("MerchantID", "m1")
+	if sign != nil {
+		SignGatewayHeaders(req, sign)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code, l
+}
+
+func TestMerchantBindIgnoresKey(t *testing.T) {
+	useTestRedis(t)
+	TrustGatewayHeaders = true
+	defer func() { TrustGatewayHeaders = false }()
+
+	code, l := gatewayRequest(t, MerchantBindMiddleware([]byte("k")), nil)
+	if code != http.StatusOK || l.AccountID != "acct" {
+		t.Fatalf("got %d %+v, want unsigned headers bound as before", code, l)
+	}
+}
+
+func TestSignedMerchantBind(t *testing.T) {
+	useTestRedis(t)
+	key := []byte("gateway-key")
+	h := SignedMerchantBindMiddleware(key)
+
+	if code, _ := gatewayRequest(t, h, nil); code != http.StatusUnauthorized {
+		t.Fatalf("unsigned status = %d, want 401", code)
+	}
+	if code, _ := gatewayRequest(t, h, []byte("other")); code != http.StatusUnauthorized {
+		t.Fatalf("wrong key status = %d, want 401", code)
+	}
+	code, l := gatewayRequest(t, h, key)
+	if code != http.StatusOK || l.AccountID != "acct" || l.MerchantID != "m1" {
+		t.Fatalf("got %d %+v", code, l)
+	}
+}
@@ -0,0 +1,69 @@
+package middle
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TrustGatewayHeaders 为 true 时信任网关传入的身份头部
+// 默认 false，未经认证中间件写入的身份头部会被清除，防止客户端伪造
+var TrustGatewayHeaders = false
+
+// TenantClaim bearer token 中携带租户的 claim，Issuer 签发时写入
+// 只有签名或内省结果中的租户会写入 Identity，X-Tenant-ID 头部不会
+var TenantClaim = "tenant_id"
+
+// IdentityHeaders WriteIntoHeader/LoadFromHeader 使用的身份头部
+var IdentityHeaders = []string{
+	"Namespace",
+	"AccountID",
+	"UserID",
+	"Phone",
+	"MerchantID",
+	"UserName",
+	"Avatar",
+	"LoginType",
+	"LoginLevel",
+}
+
+// identityKey 私有的 context key，只有本包的认证中间件可以写入
+type identityKey struct{}
+
+// Identity 返回认证中间件写入的登陆信息
+// 返回的是副本，修改不会影响后续中间件与处理函数
+func Identity(ctx context.Context) (LoginInfo, bool) {
+	l, ok := ctx.Value(identityKey{}).(LoginInfo)
+	return l, ok
+}
+
+func withIdentity(ctx context.Context, l LoginInfo) context.Context {
+	// 密钥不随请求传递
+	l.OPTSecret = ""
+	return context.WithValue(ctx, identityKey{}, l)
+}
+
+// StripIdentityHeaders 清除客户端传入的身份头部
+// 建议作为全局中间件挂载在所有认证中间件之前，TrustGatewayHeaders 为 true 时不做处理
+// 使用网关签名头部的路由(SignedMerchantBindMiddleware)不要挂载，否则签名无法校验
+func StripIdentityHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !TrustGatewayHeaders {
+			stripIdentityHeaders(c)
+		}
+		c.Next()
+	}
+}
+
+// stripUntrustedIdentityHeaders 认证步骤绑定身份前调用，未开启可信网关模式时清除身份头部
+func stripUntrustedIdentityHeaders(c *gin.Context) {
+	if !TrustGatewayHeaders {
+		stripIdentityHeaders(c)
+	}
+}
+
+func stripIdentityHeaders(c *gin.Context) {
+	for _, h := range IdentityHeaders {
+		c.Request.Header.Del(h)
+	}
+}
@@ -0,0 +1,82 @@
+package middle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/open4go/model"
+)
+
+func bearerIdentity(t *testing.T, claims jwt.MapClaims, header http.Header) (LoginInfo, string, http.Header) {
+	t.Helper()
+	var (
+		l     LoginInfo
+		scope string
+		seen  http.Header
+	)
+	r := gin.New()
+	r.GET("/res", JWTAuthMiddleware(testBearerSecret), func(c *gin.Context) {
+		l, _ = Identity(c.Request.Context())
+		scope, _ = c.Request.Context().Value(model.MerchantKey).(string)
+		seen = c.Request.Header.Clone()
+	})
+	req := httptest.NewRequest(http.MethodGet, "/res", nil)
+	for k, v := range header {
+		req.Header.Set(k, v[0])
+	}
+	req.Header.Set("Authorization", "Bearer "+signBearer(t, claims))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	return l, scope, seen
+}
+
+func TestBearerTenantComesFromClaim(t *testing.T) {
+	useTestRedis(t)
+	now := time.Now()
+	base := jwt.MapClaims{"sub": "acct", "jti": "j", "iss": "test", "aud": "app", "exp": now.Add(time.Hour).Unix()}
+	spoofed := http.Header{TenantIDHeader: {"victim"}}
+
+	l, scope, _ := bearerIdentity(t, base, spoofed)
+	if l.MerchantID != "" {
+		t.Fatalf("identity tenant = %q, want empty without a tenant claim", l.MerchantID)
+	}
+	if scope != "victim" {
+		t.Fatalf("data scope = %q, want header fallback", scope)
+	}
+
+	withTenant := jwt.MapClaims{TenantClaim: "t1"}
+	for k, v := range base {
+		withTenant[k] = v
+	}
+	l, scope, _ = bearerIdentity(t, withTenant, nil)
+	if l.MerchantID != "t1" || scope != "t1" {
+		t.Fatalf("identity tenant = %q, scope = %q, want t1", l.MerchantID, scope)
+	}
+}
+
+func TestAuthenticatorsStripIdentityHeaders(t *testing.T) {
+	useTestRedis(t)
+	claims := jwt.MapClaims{"sub": "acct", "jti": "j", "iss": "test", "aud": "app", "exp": time.Now().Add(time.Hour).Unix()}
+	forged := http.Header{"AccountID": {"admin"}, "MerchantID": {"victim"}, "LoginLevel": {"9"}}
+
+	_, _, seen := bearerIdentity(t, claims, forged)
+	for _, h := range []string{"AccountID", "MerchantID", "LoginLevel"} {
+		if v := seen.Get(h); v != "" {
+			t.Errorf("%s = %q reached the handler", h, v)
+		}
+	}
+
+	TrustGatewayHeaders = true
+	defer func() { TrustGatewayHeaders = false }()
+	_, _, seen = bearerIdentity(t, claims, forged)
+	if seen.Get("AccountID") != "admin" {
+		t.Fatal("trusted gateway headers should be kept")
+	}
+}
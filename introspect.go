@@ -0,0 +1,221 @@
+package middle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/open4go/log"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// IntrospectionCacheKeyPrefix 内省结果缓存，key 为 token 摘要，缓存到 token 过期
+	IntrospectionCacheKeyPrefix = "introspect:"
+)
+
+// ErrTokenInactive 内省端点返回 active=false
+var ErrTokenInactive = errors.New("token is not active")
+
+// IntrospectionOptions RFC 7662 内省配置
+type IntrospectionOptions struct {
+	// Endpoint 内省地址
+	Endpoint string
+	// ClientID/ClientSecret 调用内省端点时使用的 basic 认证
+	ClientID     string
+	ClientSecret string
+	// Client 默认 10 秒超时
+	Client *http.Client
+	// Issuers/Audience 与 JWTAuthOptions 含义相同，为空时不校验
+	Issuers  []string
+	Audience string
+	// MaxCacheTTL 缓存时间上限，0 表示缓存到 exp
+	MaxCacheTTL time.Duration
+}
+
+// IntrospectionResponse 内省端点的返回
+type IntrospectionResponse struct {
+	Active    bool        `json:"active"`
+	Scope     string      `json:"scope,omitempty"`
+	ClientID  string      `json:"client_id,omitempty"`
+	Username  string      `json:"username,omitempty"`
+	TokenType string      `json:"token_type,omitempty"`
+	Exp       int64       `json:"exp,omitempty"`
+	Iat       int64       `json:"iat,omitempty"`
+	Nbf       int64       `json:"nbf,omitempty"`
+	Sub       string      `json:"sub,omitempty"`
+	Aud       interface{} `json:"aud,omitempty"`
+	Iss       string      `json:"iss,omitempty"`
+	Jti       string      `json:"jti,omitempty"`
+	// TenantID 授权服务返回的租户，写入 Identity
+	TenantID string `json:"tenant_id,omitempty"`
+}
+
+// IntrospectionMiddleware 使用内省端点校验不透明 token
+// 写入的上下文与 JWTAuthMiddleware 相同：accountId/iss/aud/jti/scopes
+func IntrospectionMiddleware(opts IntrospectionOptions) gin.HandlerFunc {
+	return authMiddleware(IntrospectionAuthenticator(opts))
+}
+
+// IntrospectionAuthenticator IntrospectionMiddleware 的认证步骤，可在 AuthRegistry 中使用
+func IntrospectionAuthenticator(opts IntrospectionOptions) Authenticator {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return func(c *gin.Context) bool {
+		setAuthScheme(c, SchemeBearer)
+		stripUntrustedIdentityHeaders(c)
+		ctx := c.Request.Context()
+		parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2)
+		if len(parts) != 2 || parts[0] != "Bearer" || parts[1] == "" {
+			log.Log(ctx).Error("authorization header is required")
+			abortAuth(c, AuthCodeMissingHeader, "authorization header format must be Bearer {token}")
+			return false
+		}
+
+		rs, err := opts.introspect(ctx, parts[1])
+		if errors.Is(err, ErrTokenInactive) {
+			abortAuth(c, AuthCodeInvalidToken, "invalid token")
+			return false
+		}
+		if err != nil {
+			// 授权服务不可用时返回 503，客户端不应丢弃 token
+			log.Log(ctx).WithError(err).Error("failed to introspect token")
+			abortUnavailable(c, AuthCodeIntrospectionUnavailable, "token introspection failed")
+			return false
+		}
+
+		aud, claimErr := opts.validate(rs)
+		if claimErr != nil {
+			log.Log(ctx).WithField("code", claimErr.code).Error(claimErr)
+			abortAuth(c, claimErr.code, claimErr.msg)
+			return false
+		}
+		if rs.Sub == "" {
+			abortAuth(c, AuthCodeInvalidSubject, "invalid token subject")
+			return false
+		}
+
+		revoked, err := IsTokenRevoked(ctx, rs.Jti, rs.Sub, unixTime(rs.Iat))
+		if err != nil {
+			log.Log(ctx).WithField("jti", rs.Jti).Error(err)
+			abortUnavailable(c, AuthCodeRevocationUnavailable, "token revocation check is unavailable")
+			return false
+		}
+		if revoked {
+			abortAuth(c, AuthCodeTokenRevoked, "token has been revoked")
+			return false
+		}
+
+		scopes := strings.Fields(rs.Scope)
+		c.Set("accountId", rs.Sub)
+		c.Set("iss", rs.Iss)
+		c.Set("aud", aud)
+		c.Set("jti", rs.Jti)
+		c.Set("scopes", scopes)
+		return bindBearerContext(c, rs.Sub, rs.TenantID, scopes)
+	}
+}
+
+// validate 复用 JWTAuthOptions 的 exp/nbf/iss/aud 校验
+func (o IntrospectionOptions) validate(rs *IntrospectionResponse) (string, *claimError) {
+	claims := map[string]interface{}{"iss": rs.Iss, "aud": rs.Aud}
+	if rs.Exp > 0 {
+		claims["exp"] = float64(rs.Exp)
+	}
+	if rs.Nbf > 0 {
+		claims["nbf"] = float64(rs.Nbf)
+	}
+	if rs.Aud == nil {
+		// 内省结果不一定包含 aud，未要求时不视为错误
+		if o.Audience != "" {
+			return "", newClaimError(AuthCodeInvalidAudience, "audience %q not found in token", o.Audience)
+		}
+		claims["aud"] = ""
+	}
+	return JWTAuthOptions{Issuers: o.Issuers, Audience: o.Audience}.validate(claims)
+}
+
+// introspect 优先读取缓存，只缓存 active 的结果
+func (o IntrospectionOptions) introspect(ctx context.Context, token string) (*IntrospectionResponse, error) {
+	sum := sha256.Sum256([]byte(token))
+	cacheKey := IntrospectionCacheKeyPrefix + hex.EncodeToString(sum[:])
+	// 缓存不可用时直接请求授权服务
+	handler, err := middleRedis(ctx)
+	cached := ""
+	if err == nil {
+		cached, err = handler.Get(ctx, cacheKey).Result()
+	}
+	if err == nil {
+		var rs IntrospectionResponse
+		if err := json.Unmarshal([]byte(cached), &rs); err == nil {
+			return &rs, nil
+		}
+	} else if !errors.Is(err, redis.Nil) {
+		log.Log(ctx).WithError(err).Error("failed to read introspection cache")
+	}
+
+	rs, err := o.call(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !rs.Active {
+		return nil, ErrTokenInactive
+	}
+
+	if ttl := o.cacheTTL(rs); ttl > 0 && handler != nil {
+		payload, _ := json.Marshal(rs)
+		if err := handler.Set(ctx, cacheKey, payload, ttl).Err(); err != nil {
+			log.Log(ctx).WithError(err).Error("failed to cache introspection result")
+		}
+	}
+	return rs, nil
+}
+
+func (o IntrospectionOptions) cacheTTL(rs *IntrospectionResponse) time.Duration {
+	if rs.Exp == 0 {
+		// 没有过期时间时不缓存，避免 token 被吊销后仍然可用
+		return 0
+	}
+	ttl := time.Until(time.Unix(rs.Exp, 0))
+	if o.MaxCacheTTL > 0 && ttl > o.MaxCacheTTL {
+		ttl = o.MaxCacheTTL
+	}
+	return ttl
+}
+
+func (o IntrospectionOptions) call(ctx context.Context, token string) (*IntrospectionResponse, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	}
+
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected introspection response status: %d", resp.StatusCode)
+	}
+
+	var rs IntrospectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rs); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
@@ -0,0 +1,125 @@
+package middle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/open4go/model"
+)
+
+type introspectionServer struct {
+	*httptest.Server
+	calls  atomic.Int32
+	status int
+	resp   IntrospectionResponse
+}
+
+func newIntrospectionServer(t *testing.T, resp IntrospectionResponse) *introspectionServer {
+	t.Helper()
+	s := &introspectionServer{status: http.StatusOK, resp: resp}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		if user, pass, ok := r.BasicAuth(); !ok || user != "client" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("token") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(s.status)
+		_ = json.NewEncoder(w).Encode(s.resp)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func introspectRequest(t *testing.T, srv *introspectionServer, token string) (int, string, LoginInfo, string) {
+	t.Helper()
+	var (
+		l     LoginInfo
+		scope string
+	)
+	r := gin.New()
+	h := IntrospectionMiddleware(IntrospectionOptions{Endpoint: srv.URL, ClientID: "client", ClientSecret: "secret", Audience: "app"})
+	r.GET("/res", h, func(c *gin.Context) {
+		l, _ = Identity(c.Request.Context())
+		scope, _ = c.Request.Context().Value(model.MerchantKey).(string)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/res", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var body struct {
+		Code string `json:"code"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body.Code, l, scope
+}
+
+func TestIntrospectionActive(t *testing.T) {
+	useTestRedis(t)
+	srv := newIntrospectionServer(t, IntrospectionResponse{Active: true, Sub: "acct", Aud: "app", Jti: "j1",
+		TenantID: "t1", Scope: "orders:read", Exp: time.Now().Add(time.Hour).Unix()})
+
+	code, _, l, scope := introspectRequest(t, srv, "opaque-1")
+	if code != http.StatusOK || l.AccountID != "acct" || l.MerchantID != "t1" || scope != "t1" {
+		t.Fatalf("got %d %+v scope %q", code, l, scope)
+	}
+}
+
+func TestIntrospectionInactive(t *testing.T) {
+	mr := useTestRedis(t)
+	srv := newIntrospectionServer(t, IntrospectionResponse{Active: false})
+
+	code, reason, _, _ := introspectRequest(t, srv, "opaque-1")
+	if code != http.StatusUnauthorized || reason != AuthCodeInvalidToken {
+		t.Fatalf("got %d %q, want 401 %q", code, reason, AuthCodeInvalidToken)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("inactive result cached: %v", keys)
+	}
+}
+
+func TestIntrospectionCacheHit(t *testing.T) {
+	useTestRedis(t)
+	srv := newIntrospectionServer(t, IntrospectionResponse{Active: true, Sub: "acct", Aud: "app", Jti: "j1",
+		Exp: time.Now().Add(time.Hour).Unix()})
+
+	for i := 0; i < 3; i++ {
+		if code, _, _, _ := introspectRequest(t, srv, "opaque-1"); code != http.StatusOK {
+			t.Fatalf("request %d: status = %d", i, code)
+		}
+	}
+	if n := srv.calls.Load(); n != 1 {
+		t.Fatalf("introspection calls = %d, want 1", n)
+	}
+
+	// 不同的 token 不会命中缓存
+	introspectRequest(t, srv, "opaque-2")
+	if n := srv.calls.Load(); n != 2 {
+		t.Fatalf("introspection calls = %d, want 2", n)
+	}
+}
+
+func TestIntrospectionUpstreamError(t *testing.T) {
+	useTestRedis(t)
+	srv := newIntrospectionServer(t, IntrospectionResponse{Active: true, Sub: "acct"})
+	srv.status = http.StatusBadGateway
+
+	code, reason, _, _ := introspectRequest(t, srv, "opaque-1")
+	if code != http.StatusServiceUnavailable || reason != AuthCodeIntrospectionUnavailable {
+		t.Fatalf("got %d %q, want 503 %q", code, reason, AuthCodeIntrospectionUnavailable)
+	}
+
+	srv.Close()
+	code, reason, _, _ = introspectRequest(t, srv, "opaque-1")
+	if code != http.StatusServiceUnavailable || reason != AuthCodeIntrospectionUnavailable {
+		t.Fatalf("unreachable: got %d %q", code, reason)
+	}
+}
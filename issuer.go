@@ -0,0 +1,199 @@
+package middle
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// CookieName 后台登陆 cookie 名称，与 checkAuth 读取的一致
+	CookieName = "jwt"
+	// DefaultAccessTokenTTL 客户端 bearer token 默认有效期
+	DefaultAccessTokenTTL = 2 * time.Hour
+	// DefaultCookieTTL 后台 cookie 默认有效期
+	DefaultCookieTTL = 12 * time.Hour
+)
+
+// Issuer 签发与本包中间件相匹配的 token
+// bearer token 供 JWTAuthMiddleware 校验，cookie 供 JWTMiddleware 校验
+type Issuer struct {
+	// Name 写入 iss
+	Name string
+	// Audience 写入 aud
+	Audience string
+
+	// Method/Key/KeyID bearer token 的签名算法、私钥(或HMAC密钥)与 kid
+	// 例如 jwt.SigningMethodRS256 + *rsa.PrivateKey，或 jwt.SigningMethodHS256 + []byte
+	Method jwt.SigningMethod
+	Key    interface{}
+	KeyID  string
+	// AccessTTL bearer token 有效期，默认 DefaultAccessTokenTTL
+	AccessTTL time.Duration
+	// RefreshTTL 刷新令牌族的最长有效期，默认 DefaultRefreshTokenTTL
+	RefreshTTL time.Duration
+
+	// Keyring 用于签发后台 cookie，使用其中的 active 密钥
+	Keyring *Keyring
+	// CookieTTL 后台 cookie 有效期，默认 DefaultCookieTTL
+	CookieTTL    time.Duration
+	CookieDomain string
+	CookiePath   string
+	// RefreshCookiePath 刷新令牌 cookie 的 Path，默认 DefaultRefreshCookiePath
+	// 需要同时覆盖 RefreshHandler 所在路由与 SignOutPath
+	RefreshCookiePath string
+	// CookieInsecure 仅用于本地 http 调试，默认 cookie 带 Secure
+	CookieInsecure bool
+	// SameSite 默认 http.SameSiteLaxMode
+	SameSite http.SameSite
+
+	// Now 当前时间，便于测试注入，默认 time.Now
+	Now func() time.Time
+}
+
+func (i *Issuer) now() time.Time {
+	if i.Now != nil {
+		return i.Now()
+	}
+	return time.Now()
+}
+
+// IssueAccessToken 为客户端签发 bearer token，返回 token 与过期时间
+// claims 布局与 JWTAuthMiddleware 一致：sub 为 AccountID，另含 iss/aud/jti/iat/exp，有商户时带 TenantClaim
+func (i *Issuer) IssueAccessToken(l LoginInfo) (string, time.Time, error) {
+	token, _, expiresAt, err := i.signAccessToken(l)
+	return token, expiresAt, err
+}
+
+func (i *Issuer) signAccessToken(l LoginInfo) (string, string, time.Time, error) {
+	if i.Method == nil || i.Key == nil {
+		return "", "", time.Time{}, errors.New("issuer has no bearer signing key")
+	}
+	if l.AccountID == "" {
+		return "", "", time.Time{}, errors.New("login info has no account id")
+	}
+
+	ttl := i.AccessTTL
+	if ttl <= 0 {
+		ttl = DefaultAccessTokenTTL
+	}
+	now := i.now()
+	expiresAt := now.Add(ttl)
+
+	jti := uuid.New().String()
+	claims := jwt.MapClaims{
+		"sub": l.AccountID,
+		"iss": i.Name,
+		"aud": i.Audience,
+		"jti": jti,
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": expiresAt.Unix(),
+	}
+	if l.MerchantID != "" {
+		claims[TenantClaim] = l.MerchantID
+	}
+	token := jwt.NewWithClaims(i.Method, claims)
+	if i.KeyID != "" {
+		token.Header["kid"] = i.KeyID
+	}
+	signed, err := token.SignedString(i.Key)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return signed, jti, expiresAt, nil
+}
+
+// IssueCookieToken 为后台签发 cookie 中使用的 token，返回 token 与过期时间
+func (i *Issuer) IssueCookieToken(l LoginInfo) (string, time.Time, error) {
+	token, _, expiresAt, err := i.signCookieToken(l)
+	return token, expiresAt, err
+}
+
+func (i *Issuer) signCookieToken(l LoginInfo) (string, string, time.Time, error) {
+	if i.Keyring == nil {
+		return "", "", time.Time{}, errors.New("issuer has no keyring")
+	}
+	key, err := i.Keyring.Active()
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	ttl := i.CookieTTL
+	if ttl <= 0 {
+		ttl = DefaultCookieTTL
+	}
+	now := i.now()
+	expiresAt := now.Add(ttl)
+
+	jti := uuid.New().String()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, NewLoginClaims(l, jwt.StandardClaims{
+		Id:        jti,
+		Subject:   l.AccountID,
+		Issuer:    i.Name,
+		Audience:  i.Audience,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	}))
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	signed, err := token.SignedString(key.Secret)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return signed, jti, expiresAt, nil
+}
+
+// SetCookie 签发后台 token 并写入 Secure/HttpOnly/SameSite cookie
+func (i *Issuer) SetCookie(c *gin.Context, l LoginInfo) error {
+	token, expiresAt, err := i.IssueCookieToken(l)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(c.Writer, i.cookie(CookieName, token, expiresAt))
+	return nil
+}
+
+// ClearCookie 删除后台 cookie，通常在退出登陆时调用
+func (i *Issuer) ClearCookie(c *gin.Context) {
+	for _, name := range []string{CookieName, RefreshCookieName} {
+		cookie := i.cookie(name, "", time.Unix(0, 0))
+		cookie.MaxAge = -1
+		http.SetCookie(c.Writer, cookie)
+	}
+}
+
+func (i *Issuer) cookie(name string, value string, expiresAt time.Time) *http.Cookie {
+	path := i.CookiePath
+	if path == "" {
+		path = "/"
+	}
+	if name == RefreshCookieName {
+		path = i.RefreshCookiePath
+		if path == "" {
+			path = DefaultRefreshCookiePath
+		}
+	}
+	sameSite := i.SameSite
+	// 零值不是 http.SameSiteDefaultMode，两者都视为未设置
+	if sameSite == 0 || sameSite == http.SameSiteDefaultMode {
+		sameSite = http.SameSiteLaxMode
+	}
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   i.CookieDomain,
+		Expires:  expiresAt,
+		MaxAge:   int(expiresAt.Sub(i.now()).Seconds()),
+		Secure:   !i.CookieInsecure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	}
+}
@@ -0,0 +1,136 @@
+package middle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+func testIssuer(t *testing.T, now time.Time) *Issuer {
+	t.Helper()
+	kr, err := NewKeyring("k1", SigningKey{ID: "k1", Secret: []byte("cookie-secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr.now = func() time.Time { return now }
+	return &Issuer{
+		Name:     "idp",
+		Audience: "app",
+		Method:   jwt.SigningMethodHS256,
+		Key:      testBearerSecret,
+		KeyID:    "bearer-1",
+		Keyring:  kr,
+		Now:      func() time.Time { return now },
+	}
+}
+
+func TestIssuerAccessToken(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	i := testIssuer(t, now)
+	token, expiresAt, err := i.IssueAccessToken(LoginInfo{AccountID: "acct", MerchantID: "t1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiresAt.Equal(now.Add(DefaultAccessTokenTTL)) {
+		t.Fatalf("expiresAt = %v", expiresAt)
+	}
+
+	parsed, claims, err := parseToken(token, HMACKeyfunc(testBearerSecret))
+	if err != nil || !parsed.Valid {
+		t.Fatalf("parse: %v", err)
+	}
+	if kid := parsed.Header["kid"]; kid != "bearer-1" {
+		t.Fatalf("kid = %v", kid)
+	}
+	opts := JWTAuthOptions{Issuers: []string{"idp"}, Audience: "app", MaxAge: time.Hour, RequireExpiry: true,
+		Now: func() time.Time { return now }}
+	if aud, err := opts.validate(claims); err != nil || aud != "app" {
+		t.Fatalf("validate = %q, %v", aud, err)
+	}
+	if claims["sub"] != "acct" || claims[TenantClaim] != "t1" || claims["jti"] == "" {
+		t.Fatalf("claims = %v", claims)
+	}
+
+	if _, _, err := (&Issuer{}).IssueAccessToken(LoginInfo{AccountID: "acct"}); err == nil {
+		t.Fatal("expected error without signing key")
+	}
+	if _, _, err := i.IssueAccessToken(LoginInfo{}); err == nil {
+		t.Fatal("expected error without account id")
+	}
+}
+
+func TestIssuerCookieToken(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	i := testIssuer(t, now)
+	token, _, err := i.IssueCookieToken(LoginInfo{AccountID: "acct", UserName: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseJWTToken(token, i.Keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := parsed.Header["kid"]; kid != "k1" {
+		t.Fatalf("kid = %v", kid)
+	}
+	l, err := extractClaims(parsed)
+	if err != nil || l.AccountID != "acct" || l.UserName != "alice" {
+		t.Fatalf("login info = %+v, %v", l, err)
+	}
+	claims := parsed.Claims.(*LoginClaims)
+	if claims.Issuer != "idp" || claims.Audience != "app" || claims.Id == "" {
+		t.Fatalf("claims = %+v", claims.StandardClaims)
+	}
+
+	// cookie token 不能当作 bearer token 使用
+	if _, _, err := parseToken(token, HMACKeyfunc(testBearerSecret)); err == nil {
+		t.Fatal("cookie token verified with bearer key")
+	}
+}
+
+func TestIssuerSetCookieAttributes(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	i := testIssuer(t, now)
+	i.CookieTTL = time.Hour
+	i.CookieDomain = "example.com"
+
+	issue := func(i *Issuer) *http.Cookie {
+		t.Helper()
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		if err := i.SetCookie(c, LoginInfo{AccountID: "acct"}); err != nil {
+			t.Fatal(err)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != CookieName {
+			t.Fatalf("cookies = %v", cookies)
+		}
+		return cookies[0]
+	}
+
+	cookie := issue(i)
+	if cookie.MaxAge != 3600 || !cookie.Secure || !cookie.HttpOnly ||
+		cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/" || cookie.Domain != "example.com" {
+		t.Fatalf("cookie = %+v", cookie)
+	}
+
+	i.CookieInsecure = true
+	i.SameSite = http.SameSiteStrictMode
+	cookie = issue(i)
+	if cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("cookie = %+v", cookie)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	i.ClearCookie(c)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge >= 0 || cookie.Value != "" {
+			t.Fatalf("cleared cookie = %+v", cookie)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package middle
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/open4go/log"
+)
+
+const (
+	// DefaultJWKSRefreshInterval 远程公钥集默认刷新周期
+	DefaultJWKSRefreshInterval = 10 * time.Minute
+	// 遇到未知kid时两次强制刷新的最小间隔，避免被伪造kid刷爆
+	jwksMissRefreshInterval = 30 * time.Second
+)
+
+var (
+	ErrKeyNotFound        = errors.New("signing key not found")
+	ErrKeyAlgMismatch     = errors.New("signing method does not match key type")
+	ErrUnsupportedKeyType = errors.New("unsupported jwk key type")
+)
+
+// jwk 单个公钥的 JSON 表示 (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC / OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type publicKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// KeySet 按 kid 挑选公钥用于校验 RS256/ES256/EdDSA 签名
+// 只需持有公钥，私钥仅保留在签发token的服务中
+type KeySet struct {
+	mu          sync.RWMutex
+	keys        map[string]publicKey
+	url         string
+	client      *http.Client
+	lastRefresh time.Time
+	// missMu 串行化未知 kid 触发的刷新，并发请求只拉取一次
+	missMu   sync.Mutex
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewKeySet 使用固定的公钥创建 KeySet
+func NewKeySet(keys map[string]crypto.PublicKey) *KeySet {
+	ks := &KeySet{keys: make(map[string]publicKey, len(keys))}
+	for kid, key := range keys {
+		ks.keys[kid] = publicKey{key: key}
+	}
+	return ks
+}
+
+// LoadJWKSFile 从磁盘上的 JWKS 文件加载公钥
+func LoadJWKSFile(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &KeySet{keys: keys}, nil
+}
+
+// NewRemoteKeySet 从 url 加载 JWKS，并按 refresh 周期在后台刷新
+// refresh <= 0 时使用 DefaultJWKSRefreshInterval
+func NewRemoteKeySet(ctx context.Context, url string, refresh time.Duration) (*KeySet, error) {
+	if refresh <= 0 {
+		refresh = DefaultJWKSRefreshInterval
+	}
+	ks := &KeySet{
+		keys:   map[string]publicKey{},
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		stop:   make(chan struct{}),
+	}
+	if err := ks.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	go ks.refreshLoop(refresh)
+	return ks, nil
+}
+
+func (k *KeySet) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := k.Refresh(context.Background()); err != nil {
+				// 刷新失败时继续使用旧的公钥
+				log.Log(context.Background()).WithField("url", k.url).
+					WithError(err).Error("failed to refresh jwks")
+			}
+		case <-k.stop:
+			return
+		}
+	}
+}
+
+// Refresh 重新拉取远程 JWKS，仅对 NewRemoteKeySet 创建的 KeySet 有效
+func (k *KeySet) Refresh(ctx context.Context) error {
+	if k.url == "" {
+		return nil
+	}
+	k.mu.Lock()
+	k.lastRefresh = time.Now()
+	k.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected jwks response status: %d", resp.StatusCode)
+	}
+
+	var doc json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return err
+	}
+	keys, err := parseJWKS(doc)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// Close 停止后台刷新
+func (k *KeySet) Close() {
+	if k.stop == nil {
+		return
+	}
+	k.stopOnce.Do(func() { close(k.stop) })
+}
+
+// Lookup 根据 kid 查找公钥
+func (k *KeySet) Lookup(kid string) (crypto.PublicKey, bool) {
+	pk, ok := k.lookup(kid)
+	return pk.key, ok
+}
+
+func (k *KeySet) lookup(kid string) (publicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if kid == "" && len(k.keys) == 1 {
+		// 只有一个公钥时允许 token 不携带 kid
+		for _, pk := range k.keys {
+			return pk, true
+		}
+	}
+	pk, ok := k.keys[kid]
+	return pk, ok
+}
+
+// Keyfunc 供 jwt.Parse 使用，根据 token 头部的 kid 选出公钥并校验算法
+func (k *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	pk, ok := k.lookup(kid)
+	if !ok {
+		var err error
+		if pk, ok, err = k.refreshOnMiss(kid); err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: kid %q", ErrKeyNotFound, kid)
+	}
+
+	if pk.alg != "" && pk.alg != token.Method.Alg() {
+		return nil, fmt.Errorf("%w: %s", ErrKeyAlgMismatch, token.Method.Alg())
+	}
+	if !methodMatchesKey(token.Method, pk.key) {
+		return nil, fmt.Errorf("%w: %s", ErrKeyAlgMismatch, token.Method.Alg())
+	}
+	return pk.key, nil
+}
+
+// refreshOnMiss 等待其它请求的刷新完成后再查找，仍然缺失时才重新拉取
+func (k *KeySet) refreshOnMiss(kid string) (publicKey, bool, error) {
+	if k.url == "" {
+		return publicKey{}, false, nil
+	}
+	k.missMu.Lock()
+	defer k.missMu.Unlock()
+	if pk, ok := k.lookup(kid); ok {
+		return pk, true, nil
+	}
+	if !k.shouldRefreshOnMiss() {
+		return publicKey{}, false, nil
+	}
+	if err := k.Refresh(context.Background()); err != nil {
+		return publicKey{}, false, err
+	}
+	pk, ok := k.lookup(kid)
+	return pk, ok, nil
+}
+
+func (k *KeySet) shouldRefreshOnMiss() bool {
+	if k.url == "" {
+		return false
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return time.Since(k.lastRefresh) > jwksMissRefreshInterval
+}
+
+// methodMatchesKey 防止算法混淆，例如用 RSA 公钥当作 HMAC 密钥
+func methodMatchesKey(method jwt.SigningMethod, key crypto.PublicKey) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		switch method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return true
+		}
+	case *ecdsa.PublicKey:
+		_, ok := method.(*jwt.SigningMethodECDSA)
+		return ok
+	case ed25519.PublicKey:
+		_, ok := method.(*signingMethodEdDSA)
+		return ok
+	}
+	return false
+}
+
+func parseJWKS(data []byte) (map[string]publicKey, error) {
+	var doc jwks
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]publicKey, len(doc.Keys))
+	for _, item := range doc.Keys {
+		if item.Use != "" && item.Use != "sig" {
+			continue
+		}
+		key, err := item.publicKey()
+		if errors.Is(err, ErrUnsupportedKeyType) {
+			// 忽略不支持的类型，保证其它公钥可用
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk %q: %w", item.Kid, err)
+		}
+		keys[item.Kid] = publicKey{alg: item.Alg, key: key}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks contains no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (j jwk) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("rsa exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("%w: crv %s", ErrUnsupportedKeyType, j.Crv)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("ec point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("%w: crv %s", ErrUnsupportedKeyType, j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 public key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedKeyType, j.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,212 @@
+package middle
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+type jwksServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	keys  []jwk
+	fetch atomic.Int32
+}
+
+func newJWKSServer(t *testing.T, keys ...jwk) *jwksServer {
+	t.Helper()
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetch.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(jwks{Keys: s.keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) serve(keys ...jwk) {
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func rsaJWK(t *testing.T, kid string) (*rsa.PrivateKey, jwk) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, jwk{Kty: "RSA", Kid: kid, Alg: "RS256", Use: "sig",
+		N: b64(key.N.Bytes()), E: b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJWK(t *testing.T, kid string) (*ecdsa.PrivateKey, jwk) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, jwk{Kty: "EC", Kid: kid, Alg: "ES256", Crv: "P-256",
+		X: b64(key.X.FillBytes(make([]byte, 32))), Y: b64(key.Y.FillBytes(make([]byte, 32)))}
+}
+
+func edJWK(t *testing.T, kid string) (ed25519.PrivateKey, jwk) {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, jwk{Kty: "OKP", Kid: kid, Alg: "EdDSA", Crv: "Ed25519", X: b64(pub)}
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.StandardClaims{Subject: "acct", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// keyfuncErrorIs jwt-go v3 的 ValidationError 没有实现 Unwrap
+func keyfuncErrorIs(err, target error) bool {
+	var ve *jwt.ValidationError
+	if errors.As(err, &ve) {
+		return errors.Is(ve.Inner, target)
+	}
+	return errors.Is(err, target)
+}
+
+func TestRemoteKeySetFetch(t *testing.T) {
+	rsaKey, rsaPub := rsaJWK(t, "rsa")
+	ecKey, ecPub := ecJWK(t, "ec")
+	edKey, edPub := edJWK(t, "ed")
+	srv := newJWKSServer(t, rsaPub, ecPub, edPub, jwk{Kty: "oct", Kid: "hmac"})
+
+	ks, err := NewRemoteKeySet(context.Background(), srv.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+
+	cases := []struct {
+		method jwt.SigningMethod
+		kid    string
+		key    interface{}
+	}{
+		{jwt.SigningMethodRS256, "rsa", rsaKey},
+		{jwt.SigningMethodES256, "ec", ecKey},
+		{SigningMethodEdDSA, "ed", edKey},
+	}
+	for _, tc := range cases {
+		if _, err := jwt.Parse(signTestToken(t, tc.method, tc.kid, tc.key), ks.Keyfunc); err != nil {
+			t.Errorf("%s: %v", tc.kid, err)
+		}
+	}
+	if _, ok := ks.Lookup("hmac"); ok {
+		t.Error("unsupported key type should be skipped")
+	}
+}
+
+func TestRemoteKeySetRefreshOnUnknownKid(t *testing.T) {
+	_, oldPub := rsaJWK(t, "old")
+	newKey, newPub := rsaJWK(t, "new")
+	srv := newJWKSServer(t, oldPub)
+
+	ks, err := NewRemoteKeySet(context.Background(), srv.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+
+	srv.serve(oldPub, newPub)
+	token := signTestToken(t, jwt.SigningMethodRS256, "new", newKey)
+
+	// 刚刷新过，未知 kid 不会再次拉取
+	if _, err := jwt.Parse(token, ks.Keyfunc); err == nil {
+		t.Fatal("expected unknown kid within miss interval to fail")
+	}
+	if n := srv.fetch.Load(); n != 1 {
+		t.Fatalf("fetch count = %d, want 1", n)
+	}
+
+	ks.mu.Lock()
+	ks.lastRefresh = time.Now().Add(-2 * jwksMissRefreshInterval)
+	ks.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jwt.Parse(token, ks.Keyfunc)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.fetch.Load(); n != 2 {
+		t.Fatalf("fetch count = %d, want 2 (concurrent misses share one refresh)", n)
+	}
+}
+
+func TestRemoteKeySetRejectsAlgMismatch(t *testing.T) {
+	rsaKey, rsaPub := rsaJWK(t, "rsa")
+	ecKey, ecPub := ecJWK(t, "ec")
+	srv := newJWKSServer(t, rsaPub, ecPub)
+
+	ks, err := NewRemoteKeySet(context.Background(), srv.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+
+	// 用 RSA 公钥的 n 作为 HMAC 密钥伪造 token
+	forged := signTestToken(t, jwt.SigningMethodHS256, "rsa", rsaKey.N.Bytes())
+	// jwk 声明了 RS256，使用 PS256 签名同样拒绝
+	ps := signTestToken(t, jwt.SigningMethodPS256, "rsa", rsaKey)
+	// EC 公钥不能校验 RSA 签名
+	wrongKty := signTestToken(t, jwt.SigningMethodES256, "rsa", ecKey)
+
+	for name, token := range map[string]string{"hs256": forged, "alg": ps, "kty": wrongKty} {
+		_, err := jwt.Parse(token, ks.Keyfunc)
+		if !keyfuncErrorIs(err, ErrKeyAlgMismatch) {
+			t.Errorf("%s: err = %v, want ErrKeyAlgMismatch", name, err)
+		}
+	}
+
+	// 未声明 alg 时依据 kty 判断
+	ks.mu.Lock()
+	ks.keys["rsa"] = publicKey{key: &rsaKey.PublicKey}
+	ks.mu.Unlock()
+	if _, err := jwt.Parse(forged, ks.Keyfunc); !keyfuncErrorIs(err, ErrKeyAlgMismatch) {
+		t.Errorf("kty only: err = %v, want ErrKeyAlgMismatch", err)
+	}
+}
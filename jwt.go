@@ -2,12 +2,13 @@ package middle
 
 import (
 	"errors"
-	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/open4go/log"
-	"github.com/pquerna/otp/totp"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -19,86 +20,207 @@ const (
 // 通过角色判断其是否具有该api的访问权限
 // 用户登陆完成后会将权限配置信息写入 redis 数据库完成
 // 通过hget api/path/ role boolean
+// 路由鉴权需要开启 EnableRouteRBAC，权限通过 LoadRBACPolicy/SetAccountRoles 写入
 func JWTMiddleware(key []byte) gin.HandlerFunc {
-	return func(c *gin.Context) {
+	return JWTKeyringMiddleware(StaticKeyring(key))
+}
+
+// JWTKeyringMiddleware 与 JWTMiddleware 相同，但按 kid 从 keyring 中选择密钥
+// 轮换密钥时旧 cookie 在其密钥退役前依然有效
+func JWTKeyringMiddleware(keyring *Keyring) gin.HandlerFunc {
+	return authMiddleware(CookieAuthenticator(keyring))
+}
+
+// CookieAuthenticator JWTKeyringMiddleware 的认证步骤，可在 AuthRegistry 中使用
+func CookieAuthenticator(keyring *Keyring) Authenticator {
+	return func(c *gin.Context) bool {
+		setAuthScheme(c, SchemeCookie)
+		stripUntrustedIdentityHeaders(c)
 		reqPath := c.FullPath()
-		if reqPath == SignOutPath {
-			if checkAuth(c, key) != http.StatusOK {
+		if strings.TrimPrefix(reqPath, "/") == strings.TrimPrefix(SignOutPath, "/") {
+			claims, status := checkAuth(c, keyring)
+			if status != http.StatusOK {
 				c.AbortWithStatus(http.StatusForbidden)
-				return
+				return false
+			}
+			// 退出登陆时吊销当前 token，避免 cookie 被盗后继续使用
+			if err := signOut(c, claims); err != nil {
+				log.Log(c.Request.Context()).WithError(err).Error("Failed to revoke token on sign out")
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return false
 			}
 		} else {
-			if checkAuth(c, key) != http.StatusOK {
+			claims, status := checkAuth(c, keyring)
+			if status != http.StatusOK {
 				c.AbortWithStatus(http.StatusForbidden)
-				return
+				return false
+			}
+			// 通过角色判断其是否具有该api的访问权限
+			if EnableRouteRBAC {
+				loginInfo, _ := claims.Info()
+				if !authorizeRequest(c, loginInfo.AccountID) {
+					return false
+				}
 			}
 		}
-		c.Next()
+		return true
 	}
 }
 
-func checkAuth(c *gin.Context, key []byte) int {
+func checkAuth(c *gin.Context, keyring *Keyring) (*LoginClaims, int) {
 	// Retrieve JWT token from the "jwt" cookie
-	cookie, err := c.Cookie("jwt")
+	cookie, err := c.Cookie(CookieName)
 	if err != nil || cookie == "" {
 		log.Log(c.Request.Context()).
 			WithError(err).Error("Failed to retrieve JWT token from cookie")
+		recordAuthFailure(c, AuthCodeMissingCookie)
 		c.AbortWithStatus(http.StatusUnauthorized)
-		return http.StatusUnauthorized
+		return nil, http.StatusUnauthorized
 	}
 
 	// Parse JWT token with claims
-	token, err := parseJWTToken(cookie, key)
+	token, err := parseJWTToken(cookie, keyring)
 	if err != nil {
 		log.Log(c.Request.Context()).WithError(err).Error("Failed to parse JWT token")
+		recordAuthFailure(c, tokenFailureCode(err))
 		c.AbortWithStatus(http.StatusUnauthorized)
-		return http.StatusUnauthorized
+		return nil, http.StatusUnauthorized
 	}
 
 	// Extract claims and load them into LoginInfo struct
 	loginInfo, err := extractClaims(token)
 	if err != nil {
 		log.Log(c.Request.Context()).WithError(err).Error("Failed to extract claims")
+		recordAuthFailure(c, AuthCodeInvalidToken)
 		c.AbortWithStatus(http.StatusUnauthorized)
-		return http.StatusUnauthorized
+		return nil, http.StatusUnauthorized
+	}
+
+	// Reject revoked tokens
+	claims := token.Claims.(*LoginClaims)
+	if err := checkCookieRevoked(c, claims, cookie, loginInfo.AccountID); err != nil {
+		log.Log(c.Request.Context()).WithError(err).Error("Failed to check token revocation")
+		status := abortRevoked(c, err)
+		return nil, status
 	}
 
 	// Write parsed data into the header
 	loginInfo.WriteIntoHeader(c)
 
-	return http.StatusOK
+	return claims, http.StatusOK
+}
+
+// checkCookieRevoked 返回 ErrTokenRevoked 或查询吊销记录时的错误
+func checkCookieRevoked(c *gin.Context, claims *LoginClaims, cookie string, accountID string) error {
+	revoked, err := IsTokenRevoked(c.Request.Context(),
+		revocationID(claims.Id, cookie), accountID, unixTime(claims.IssuedAt))
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// abortRevoked 已吊销时返回 401，无法查询吊销记录时返回 503
+func abortRevoked(c *gin.Context, err error) int {
+	status, code := http.StatusUnauthorized, AuthCodeTokenRevoked
+	if !errors.Is(err, ErrTokenRevoked) {
+		status, code = http.StatusServiceUnavailable, AuthCodeRevocationUnavailable
+	}
+	recordAuthFailure(c, code)
+	c.AbortWithStatus(status)
+	return status
+}
+
+func signOut(c *gin.Context, claims *LoginClaims) error {
+	cookie, err := c.Cookie(CookieName)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request.Context()
+	if err := RevokeToken(ctx, revocationID(claims.Id, cookie), unixTime(claims.ExpiresAt)); err != nil {
+		return err
+	}
+
+	// 同时吊销刷新令牌族，否则 jwt_refresh 仍可换取新的 cookie
+	refresh, err := c.Cookie(RefreshCookieName)
+	if err != nil || refresh == "" {
+		return nil
+	}
+	if err := RevokeRefreshFamily(ctx, refresh); err != nil && !errors.Is(err, ErrRefreshTokenInvalid) {
+		return err
+	}
+	clearRefreshCookie(c)
+	return nil
 }
 
-func parseJWTToken(cookie string, key []byte) (*jwt.Token, error) {
-	return jwt.ParseWithClaims(cookie, &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return key, nil
+// clearRefreshCookie 删除 DefaultRefreshCookiePath 下的刷新令牌 cookie
+// Issuer 设置了 CookieDomain 或 RefreshCookiePath 时应再调用 Issuer.ClearCookie
+func clearRefreshCookie(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     RefreshCookieName,
+		Path:     DefaultRefreshCookiePath,
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
 	})
 }
 
+func parseJWTToken(cookie string, keyring *Keyring) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(cookie, &LoginClaims{}, rejectIdentityAssertion(keyring.Keyfunc))
+}
+
 func extractClaims(token *jwt.Token) (*LoginInfo, error) {
-	claims, ok := token.Claims.(*jwt.StandardClaims)
+	claims, ok := token.Claims.(*LoginClaims)
 	if !ok {
 		return nil, errors.New("invalid token claims")
 	}
-
-	// Load claims into LoginInfo struct
-	loginInfo := &LoginInfo{}
-	if err := loginInfo.Load(claims.Issuer); err != nil {
-		return nil, fmt.Errorf("failed to load claims into LoginInfo: %w", err)
-	}
-
-	return loginInfo, nil
+	return claims.Info()
 }
 
 // MerchantBindMiddleware 仅绑定商户信息，不校验登陆权限信息
+// key 未使用，保留以兼容原有调用；需要校验网关签名时使用 SignedMerchantBindMiddleware
 func MerchantBindMiddleware(key []byte) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		bindMerchant(c)
-		c.Next()
+	return authMiddleware(GatewayAuthenticator(nil))
+}
+
+// SignedMerchantBindMiddleware 要求网关使用 gatewayKey 对身份头部签名(见 SignGatewayHeaders)
+// 签名校验通过后才信任并绑定这些头部
+func SignedMerchantBindMiddleware(gatewayKey []byte) gin.HandlerFunc {
+	if len(gatewayKey) == 0 {
+		panic("middle: SignedMerchantBindMiddleware requires a gateway key")
 	}
+	return authMiddleware(GatewayAuthenticator(gatewayKey))
 }
 
-func bindMerchant(c *gin.Context) int {
+// GatewayAuthenticator MerchantBindMiddleware/SignedMerchantBindMiddleware 的认证步骤，可在 AuthRegistry 中使用
+// key 为空时不校验签名，是否信任头部由 TrustGatewayHeaders 决定
+func GatewayAuthenticator(key []byte) Authenticator {
+	return func(c *gin.Context) bool {
+		setAuthScheme(c, SchemeGateway)
+		if len(key) > 0 {
+			if err := VerifyGatewayHeaders(c.Request.Context(), c.Request, key); err != nil {
+				log.Log(c.Request.Context()).WithError(err).Error("Failed to verify gateway signature")
+				recordAuthFailure(c, AuthCodeInvalidSignature)
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return false
+			}
+			bindMerchant(c, true)
+		} else {
+			bindMerchant(c, TrustGatewayHeaders)
+		}
+		return true
+	}
+}
+
+func bindMerchant(c *gin.Context, trusted bool) int {
+	if !trusted {
+		// 未经签名且未开启可信网关模式时，客户端传入的身份头部一律丢弃
+		stripIdentityHeaders(c)
+	}
 	// Extract claims and load them into LoginInfo struct
 	loginInfo := LoadFromHeader(c)
 	// Write parsed data into the header
@@ -107,55 +229,157 @@ func bindMerchant(c *gin.Context) int {
 }
 
 func SecondValidateMiddleware(key []byte) gin.HandlerFunc {
-	return func(c *gin.Context) {
+	return SecondValidateKeyringMiddleware(StaticKeyring(key))
+}
 
-		// 1. 获取 TOTP code（支持 Body + Header）
-		code := getTOTPCode(c)
+// SecondValidateKeyringMiddleware 与 SecondValidateMiddleware 相同，但使用 keyring 校验 cookie
+func SecondValidateKeyringMiddleware(keyring *Keyring) gin.HandlerFunc {
+	return authMiddleware(SecondFactorAuthenticator(keyring))
+}
 
-		if code == "" {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-				"error": "缺少 TOTP 验证码 (code)",
-			})
-			return
-		}
+// SecondValidateStepUpMiddleware 二次验证成功后在 opts.TTL 内免验证访问同一类资源
+// 各路由通过 opts.Class 选择资源类别，需要显式启用，SecondValidateMiddleware 不受影响
+func SecondValidateStepUpMiddleware(keyring *Keyring, opts StepUpOptions) gin.HandlerFunc {
+	return authMiddleware(StepUpAuthenticator(keyring, opts))
+}
 
+// SecondFactorAuthenticator SecondValidateKeyringMiddleware 的认证步骤，可在 AuthRegistry 中使用
+// 与原有行为一致，每次请求都需要验证码，不读取也不写入提权授权
+func SecondFactorAuthenticator(keyring *Keyring) Authenticator {
+	return StepUpAuthenticator(keyring, StepUpOptions{TTL: -1})
+}
+
+// StepUpAuthenticator SecondValidateStepUpMiddleware 的认证步骤，可在 AuthRegistry 中使用
+func StepUpAuthenticator(keyring *Keyring, opts StepUpOptions) Authenticator {
+	return func(c *gin.Context) bool {
+		if AuthSchemeOf(c) == "" {
+			// 单独挂载时由本步骤绑定身份，跟在其它认证之后时保留已写入的头部
+			setAuthScheme(c, SchemeCookie)
+			stripUntrustedIdentityHeaders(c)
+		}
 		// Retrieve JWT token from the "jwt" cookie
-		cookie, err := c.Cookie("jwt")
+		cookie, err := c.Cookie(CookieName)
 		if err != nil || cookie == "" {
 			log.Log(c.Request.Context()).
 				WithError(err).Error("Failed to retrieve JWT token from cookie")
+			recordAuthFailure(c, AuthCodeMissingCookie)
 			c.AbortWithStatus(http.StatusUnauthorized)
-			return
+			return false
 		}
 
 		// Parse JWT token with claims
-		token, err := parseJWTToken(cookie, key)
+		token, err := parseJWTToken(cookie, keyring)
 		if err != nil {
 			log.Log(c.Request.Context()).WithError(err).Error("Failed to parse JWT token")
+			recordAuthFailure(c, tokenFailureCode(err))
 			c.AbortWithStatus(http.StatusUnauthorized)
-			return
+			return false
 		}
 
 		// Extract claims and load them into LoginInfo struct
 		loginInfo, err := extractClaims(token)
 		if err != nil {
 			log.Log(c.Request.Context()).WithError(err).Error("Failed to extract claims")
+			recordAuthFailure(c, AuthCodeInvalidToken)
 			c.AbortWithStatus(http.StatusUnauthorized)
-			return
+			return false
 		}
 
-		// 二次验证
-		b := totp.Validate(code, loginInfo.OPTSecret)
-		if !b {
+		claims := token.Claims.(*LoginClaims)
+		if err := checkCookieRevoked(c, claims, cookie, loginInfo.AccountID); err != nil {
+			log.Log(c.Request.Context()).WithError(err).Error("Failed to check token revocation")
+			abortRevoked(c, err)
+			return false
+		}
+
+		// 启用提权授权时，已有未过期的授权可免验证
+		session := revocationID(claims.Id, cookie)
+		if opts.ttl() > 0 {
+			granted, err := hasStepUpGrant(c.Request.Context(), session, opts.class())
+			if err != nil {
+				log.Log(c.Request.Context()).WithError(err).Error("failed to check step-up grant")
+			}
+			if granted {
+				return true
+			}
+		}
+
+		// 获取验证码（支持 Header + Query），或者一次性恢复码
+		code := getTOTPCode(c)
+		recoveryCode := c.GetHeader(RecoveryCodeHeader)
+
+		if code == "" && recoveryCode == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "缺少 TOTP 验证码 (code)",
+			})
+			return false
+		}
+
+		// 暴力破解保护，锁定期间直接拒绝
+		clientIP := c.ClientIP()
+		if remaining, err := totpLockRemaining(c.Request.Context(), loginInfo.AccountID, clientIP); err != nil {
+			log.Log(c.Request.Context()).WithError(err).Error("failed to check totp lockout")
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+			return false
+		} else if remaining > 0 {
+			abortTOTPLocked(c, remaining)
+			return false
+		}
+
+		var b bool
+		if code == "" {
+			// 恢复码使用后立即作废
+			b, err = consumeRecoveryCode(c.Request.Context(), loginInfo.AccountID, recoveryCode, clientIP)
+		} else {
+			// 二次验证密钥保存在服务端，不信任 cookie 中的内容；同一验证码不能重复使用
+			b, err = opts.factor().Verify(c.Request.Context(), loginInfo.AccountID, code, clientIP)
+		}
+		if errors.Is(err, ErrSecondFactorNotEnrolled) {
+			log.Log(c.Request.Context()).WithField("accountId", loginInfo.AccountID).
+				WithError(err).Error("failed to load second factor secret")
+			recordAuthFailure(c, AuthCodeSecondFactorFailed)
+			c.AbortWithStatus(http.StatusForbidden)
+			return false
+		}
+		if err != nil {
 			log.Log(c.Request.Context()).WithError(err).Error("failed to validate")
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+			return false
+		}
+		if !b {
+			log.Log(c.Request.Context()).WithField("accountId", loginInfo.AccountID).Error("failed to validate")
+			locked, err := recordTOTPFailure(c.Request.Context(), loginInfo.AccountID, clientIP)
+			if err != nil {
+				log.Log(c.Request.Context()).WithError(err).Error("failed to record totp failure")
+			}
+			if locked > 0 {
+				abortTOTPLocked(c, locked)
+				return false
+			}
+			recordAuthFailure(c, AuthCodeSecondFactorFailed)
 			c.AbortWithStatus(http.StatusForbidden)
-			return
+			return false
 		}
-		c.Next()
-
+		if err := resetTOTPFailures(c.Request.Context(), loginInfo.AccountID); err != nil {
+			log.Log(c.Request.Context()).WithError(err).Error("failed to reset totp failures")
+		}
+		if err := grantStepUp(c.Request.Context(), session, opts.class(), opts.ttl()); err != nil {
+			log.Log(c.Request.Context()).WithError(err).Error("failed to grant step-up")
+		}
+		return true
 	}
 }
 
+// abortTOTPLocked 返回 429 以及 Retry-After
+func abortTOTPLocked(c *gin.Context, remaining time.Duration) {
+	recordAuthFailure(c, AuthCodeSecondFactorLocked)
+	seconds := int64((remaining + time.Second - 1) / time.Second)
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"error": "too many failed attempts",
+	})
+}
+
 // 辅助函数：支持从 Body 和 Header 获取 code
 func getTOTPCode(c *gin.Context) string {
 	// 优先从 Header 获取
@@ -0,0 +1,189 @@
+package middle
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrNoActiveKey = errors.New("keyring has no usable active key")
+	ErrKeyRetired  = errors.New("signing key is outside its validity window")
+)
+
+// SigningKey 一个 HMAC 签名密钥及其有效期
+// NotBefore/NotAfter 为零值时表示不限制
+type SigningKey struct {
+	ID        string
+	Secret    []byte
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+func (k SigningKey) validAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && !t.Before(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// Keyring 管理后台 cookie 的签名密钥
+// 新 token 使用 active 密钥签发，其余在有效期内的密钥仍然接受校验
+// 这样轮换密钥时旧的 cookie 可以继续使用直到其密钥退役
+type Keyring struct {
+	mu     sync.RWMutex
+	active string
+	keys   map[string]SigningKey
+	now    func() time.Time
+}
+
+// NewKeyring 创建 keyring，active 必须是 keys 中的一个
+func NewKeyring(active string, keys ...SigningKey) (*Keyring, error) {
+	kr := &Keyring{keys: make(map[string]SigningKey, len(keys)), now: time.Now}
+	for _, k := range keys {
+		if len(k.Secret) == 0 {
+			return nil, fmt.Errorf("signing key %q has empty secret", k.ID)
+		}
+		kr.keys[k.ID] = k
+	}
+	if err := kr.SetActive(active); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// StaticKeyring 将旧的单一密钥包装为 keyring
+// 该密钥的 ID 为空，因此可以校验没有 kid 的历史 cookie
+func StaticKeyring(secret []byte) *Keyring {
+	return &Keyring{
+		keys: map[string]SigningKey{"": {Secret: secret}},
+		now:  time.Now,
+	}
+}
+
+// SetActive 切换用于签发的密钥
+func (k *Keyring) SetActive(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: kid %q", ErrKeyNotFound, id)
+	}
+	if !key.validAt(k.now()) {
+		return fmt.Errorf("%w: kid %q", ErrKeyRetired, id)
+	}
+	k.active = id
+	return nil
+}
+
+// Add 新增或替换一个密钥，与 NewKeyring 一样不接受空密钥
+func (k *Keyring) Add(key SigningKey) error {
+	if len(key.Secret) == 0 {
+		return fmt.Errorf("signing key %q has empty secret", key.ID)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[key.ID] = key
+	return nil
+}
+
+// Remove 立即移除密钥，使用该密钥签发的 cookie 将全部失效
+func (k *Keyring) Remove(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, id)
+}
+
+// Active 返回当前用于签发的密钥
+func (k *Keyring) Active() (SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[k.active]
+	if !ok || !key.validAt(k.now()) {
+		return SigningKey{}, ErrNoActiveKey
+	}
+	return key, nil
+}
+
+// Keyfunc 供 jwt.Parse 使用，按 kid 选出仍在有效期内的 HMAC 密钥
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+
+	k.mu.RLock()
+	key, ok := k.keys[kid]
+	now := k.now()
+	k.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: kid %q", ErrKeyNotFound, kid)
+	}
+	if !key.validAt(now) {
+		return nil, fmt.Errorf("%w: kid %q", ErrKeyRetired, kid)
+	}
+	return key.Secret, nil
+}
+
+type keyringConfig struct {
+	Active string `mapstructure:"active"`
+	Keys   []struct {
+		ID        string `mapstructure:"id"`
+		Secret    string `mapstructure:"secret"`
+		NotBefore string `mapstructure:"not_before"`
+		NotAfter  string `mapstructure:"not_after"`
+	} `mapstructure:"keys"`
+}
+
+// LoadKeyringFromViper 从配置加载 keyring，例如 LoadKeyringFromViper("jwt.keyring")
+//
+//	jwt:
+//	  keyring:
+//	    active: "2024-06"
+//	    keys:
+//	      - id: "2024-06"
+//	        secret: "..."
+//	        not_before: "2024-06-01T00:00:00Z"
+//	      - id: "2024-01"
+//	        secret: "..."
+//	        not_after: "2024-07-01T00:00:00Z"
+//	      - id: ""
+//	        secret: "..."
+//	        not_after: "2024-07-01T00:00:00Z"
+//
+// 没有 kid 的 token(包括启用 keyring 之前签发的全部 cookie)只能由 id 为 "" 的密钥校验
+func LoadKeyringFromViper(key string) (*Keyring, error) {
+	var cfg keyringConfig
+	if err := viper.UnmarshalKey(key, &cfg); err != nil {
+		return nil, err
+	}
+
+	keys := make([]SigningKey, 0, len(cfg.Keys))
+	for _, item := range cfg.Keys {
+		sk := SigningKey{ID: item.ID, Secret: []byte(item.Secret)}
+		var err error
+		if sk.NotBefore, err = parseOptionalTime(item.NotBefore); err != nil {
+			return nil, fmt.Errorf("key %q not_before: %w", item.ID, err)
+		}
+		if sk.NotAfter, err = parseOptionalTime(item.NotAfter); err != nil {
+			return nil, fmt.Errorf("key %q not_after: %w", item.ID, err)
+		}
+		keys = append(keys, sk)
+	}
+	return NewKeyring(cfg.Active, keys...)
+}
+
+func parseOptionalTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
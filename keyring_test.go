@@ -0,0 +1,137 @@
+package middle
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+)
+
+func signWithKey(t *testing.T, kid string, secret []byte) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "acct"})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func parseWithKeyring(kr *Keyring, token string) error {
+	_, err := jwt.Parse(token, kr.Keyfunc)
+	return err
+}
+
+func TestKeyringSignsWithActiveKey(t *testing.T) {
+	kr, err := NewKeyring("new",
+		SigningKey{ID: "old", Secret: []byte("old-secret")},
+		SigningKey{ID: "new", Secret: []byte("new-secret")},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := (&Issuer{Keyring: kr}).IssueCookieToken(LoginInfo{AccountID: "acct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := jwt.Parse(token, kr.Keyfunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := parsed.Header["kid"]; kid != "new" {
+		t.Fatalf("kid = %v, want new", kid)
+	}
+}
+
+func TestKeyringRetiredKeyWindow(t *testing.T) {
+	now := time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC)
+	kr, err := NewKeyring("new",
+		SigningKey{ID: "old", Secret: []byte("old-secret"), NotAfter: now.Add(time.Hour)},
+		SigningKey{ID: "new", Secret: []byte("new-secret")},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr.now = func() time.Time { return now }
+	old := signWithKey(t, "old", []byte("old-secret"))
+
+	if err := parseWithKeyring(kr, old); err != nil {
+		t.Fatalf("retired key inside window: %v", err)
+	}
+	kr.now = func() time.Time { return now.Add(time.Hour) }
+	if err := parseWithKeyring(kr, old); !keyfuncErrorIs(err, ErrKeyRetired) {
+		t.Fatalf("retired key after window = %v, want %v", err, ErrKeyRetired)
+	}
+	if err := kr.SetActive("old"); !errors.Is(err, ErrKeyRetired) {
+		t.Fatalf("activate retired key = %v, want %v", err, ErrKeyRetired)
+	}
+}
+
+func TestKeyringRejectsUnknownKid(t *testing.T) {
+	kr, err := NewKeyring("k1", SigningKey{ID: "k1", Secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parseWithKeyring(kr, signWithKey(t, "k2", []byte("secret"))); !keyfuncErrorIs(err, ErrKeyNotFound) {
+		t.Fatalf("unknown kid = %v, want %v", err, ErrKeyNotFound)
+	}
+	// 没有 kid 的 token 只能由 id 为 "" 的密钥校验
+	if err := parseWithKeyring(kr, signWithKey(t, "", []byte("secret"))); !keyfuncErrorIs(err, ErrKeyNotFound) {
+		t.Fatalf("missing kid = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestKeyringRejectsEmptySecret(t *testing.T) {
+	if _, err := NewKeyring("k1", SigningKey{ID: "k1"}); err == nil {
+		t.Fatal("NewKeyring accepted an empty secret")
+	}
+	kr := StaticKeyring([]byte("secret"))
+	if err := kr.Add(SigningKey{ID: "k2"}); err == nil {
+		t.Fatal("Add accepted an empty secret")
+	}
+	if err := parseWithKeyring(kr, signWithKey(t, "k2", nil)); !keyfuncErrorIs(err, ErrKeyNotFound) {
+		t.Fatalf("empty secret token = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestLoadKeyringFromViper(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(`
+jwt:
+  keyring:
+    active: "2024-06"
+    keys:
+      - id: "2024-06"
+        secret: "new-secret"
+        not_before: "2024-06-01T00:00:00Z"
+      - id: ""
+        secret: "legacy-secret"
+        not_after: "2999-01-01T00:00:00Z"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := LoadKeyringFromViper("jwt.keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := kr.Active(); err != nil || key.ID != "2024-06" {
+		t.Fatalf("active = %+v, %v", key, err)
+	}
+	if err := parseWithKeyring(kr, signWithKey(t, "", []byte("legacy-secret"))); err != nil {
+		t.Fatalf("legacy token without kid: %v", err)
+	}
+
+	viper.Set("jwt.keyring.keys", []map[string]interface{}{{"id": "k", "secret": "s", "not_after": "tomorrow"}})
+	viper.Set("jwt.keyring.active", "k")
+	if _, err := LoadKeyringFromViper("jwt.keyring"); err == nil {
+		t.Fatal("expected error for invalid not_after")
+	}
+}
@@ -1,6 +1,7 @@
 package middle
 
 import (
+	"context"
 	"github.com/gin-gonic/gin/binding"
 	"net/http"
 	"strconv"
@@ -11,6 +12,7 @@ import (
 	"github.com/open4go/log"
 	"github.com/open4go/log/model/login"
 	"github.com/open4go/log/model/operation"
+	"github.com/open4go/model"
 	rtime "github.com/r2day/base/time"
 	"github.com/r2day/body"
 
@@ -18,8 +20,33 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// logSink 保存一条请求日志，base 为 doc 中内嵌的 model.Model
+type logSink func(ctx context.Context, base *model.Model, collection string, doc interface{})
+
+// createLog 同步写入，每条日志一次 mongo 往返
+func createLog(db *mongo.Database) logSink {
+	return func(ctx context.Context, base *model.Model, collection string, doc interface{}) {
+		handler := base.Init(ctx, db, collection)
+		id, err := handler.Create(doc)
+		if err != nil {
+			log.Log(ctx).Error(err)
+			return
+		}
+		log.Log(ctx).WithField("id", id).Debug("after create done")
+	}
+}
+
 // LoginLogMiddleware handles login-related logging
 func LoginLogMiddleware(db *mongo.Database, skipViewLog bool) gin.HandlerFunc {
+	return loginLogMiddleware(createLog(db), skipViewLog)
+}
+
+// LoginLogWriterMiddleware 与 LoginLogMiddleware 相同，但通过 LogWriter 异步批量写入
+func LoginLogWriterMiddleware(w *LogWriter, skipViewLog bool) gin.HandlerFunc {
+	return loginLogMiddleware(w.save, skipViewLog)
+}
+
+func loginLogMiddleware(save logSink, skipViewLog bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Next()
 
@@ -62,17 +89,21 @@ func LoginLogMiddleware(db *mongo.Database, skipViewLog bool) gin.HandlerFunc {
 		m.UserID = l.UserID
 		m.AccountID = l.AccountID
 
-		handler := m.Init(c.Request.Context(), db, m.CollectionName())
-		_, err := handler.Create(m)
-		if err != nil {
-			log.Log(c.Request.Context()).Error(err)
-			return
-		}
+		save(c.Request.Context(), &m.Model, m.CollectionName(), m)
 	}
 }
 
 // OperateLogMiddleware handles operation-related logging
 func OperateLogMiddleware(db *mongo.Database) gin.HandlerFunc {
+	return operateLogMiddleware(createLog(db))
+}
+
+// OperateLogWriterMiddleware 与 OperateLogMiddleware 相同，但通过 LogWriter 异步批量写入
+func OperateLogWriterMiddleware(w *LogWriter) gin.HandlerFunc {
+	return operateLogMiddleware(w.save)
+}
+
+func operateLogMiddleware(save logSink) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		method := c.Request.Method
 
@@ -101,7 +132,7 @@ func OperateLogMiddleware(db *mongo.Database) gin.HandlerFunc {
 			// 移除 "/:_id"
 			fullPath = strings.Replace(fullPath, "/:_id", "", -1)
 			targetID := c.Param("_id")
-			saveLog(c, l, clientIP, remoteIP, fullPath, method, targetID, db)
+			saveLog(c, l, clientIP, remoteIP, fullPath, method, targetID, save)
 		}
 
 		if method == http.MethodPost {
@@ -134,12 +165,12 @@ func OperateLogMiddleware(db *mongo.Database) gin.HandlerFunc {
 				WithField("method", method).
 				WithField("targetID", targetID).
 				Debug("before save")
-			saveLog(c, l, clientIP, remoteIP, fullPath, method, targetID, db)
+			saveLog(c, l, clientIP, remoteIP, fullPath, method, targetID, save)
 		}
 	}
 }
 
-func saveLog(c *gin.Context, l LoginInfo, clientIP, remoteIP, fullPath, method string, targetID string, db *mongo.Database) {
+func saveLog(c *gin.Context, l LoginInfo, clientIP, remoteIP, fullPath, method string, targetID string, save logSink) {
 	m := &operation.Model{}
 	m.ClientIP = clientIP
 	m.RemoteIP = remoteIP
@@ -150,10 +181,5 @@ func saveLog(c *gin.Context, l LoginInfo, clientIP, remoteIP, fullPath, method s
 	m.AccountID = l.AccountID
 	m.Timestamp = uint64(time.Now().Unix())
 
-	handler := m.Init(c.Request.Context(), db, m.CollectionName())
-	id, err := handler.Create(m)
-	if err != nil {
-		log.Log(c.Request.Context()).Error(err)
-	}
-	log.Log(c.Request.Context()).WithField("id", id).Debug("after create done")
+	save(c.Request.Context(), &m.Model, m.CollectionName(), m)
 }
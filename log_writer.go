@@ -0,0 +1,300 @@
+package middle
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/open4go/log"
+	"github.com/open4go/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LogOverflow 队列已满时的处理方式
+type LogOverflow int
+
+const (
+	// LogOverflowDrop 丢弃新的日志，不影响请求耗时
+	LogOverflowDrop LogOverflow = iota
+	// LogOverflowBlock 阻塞请求直到队列有空位
+	LogOverflowBlock
+)
+
+// ErrLogWriterClosed 写入器已关闭
+var ErrLogWriterClosed = errors.New("log writer is closed")
+
+var logEntriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: MetricsNamespace,
+	Name:      "log_entries_total",
+	Help:      "Request log entries by collection and result (written, dropped, failed).",
+}, []string{"collection", "result"})
+
+func init() {
+	MetricsRegistry.MustRegister(logEntriesTotal)
+}
+
+// LogWriterOptions 异步日志写入配置
+type LogWriterOptions struct {
+	// QueueSize 队列长度，0 时为 1024
+	QueueSize int
+	// BatchSize 单次 InsertMany 的最大条数，0 时为 100
+	BatchSize int
+	// FlushInterval 未满一批时的最长等待时间，0 时为 1 秒
+	FlushInterval time.Duration
+	// Workers 写入协程数量，0 时为 1
+	Workers int
+	// Overflow 队列已满时的处理方式，默认丢弃
+	Overflow LogOverflow
+	// WriteTimeout 单次写入的超时时间，0 时为 5 秒
+	WriteTimeout time.Duration
+}
+
+type logEntry struct {
+	collection string
+	doc        interface{}
+}
+
+// LogWriter 将请求日志放入有界队列，由后台协程批量写入 mongo
+// 使用 LoginLogWriterMiddleware/OperateLogWriterMiddleware 挂载，退出前调用 Close
+type LogWriter struct {
+	db    *mongo.Database
+	opts  LogWriterOptions
+	queue chan logEntry
+	flush []chan chan struct{}
+	wg    sync.WaitGroup
+	// done 全部写入协程退出后关闭
+	done chan struct{}
+	// insertMany 写入一个集合，便于测试替换
+	insertMany func(ctx context.Context, collection string, docs []interface{}) error
+
+	mu      sync.RWMutex
+	closed  bool
+	dropped atomic.Int64
+}
+
+// NewLogWriter 创建写入器并启动写入协程
+func NewLogWriter(db *mongo.Database, opts LogWriterOptions) *LogWriter {
+	return newLogWriter(db, opts, func(ctx context.Context, collection string, docs []interface{}) error {
+		_, err := db.Collection(collection).InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		return err
+	})
+}
+
+func newLogWriter(db *mongo.Database, opts LogWriterOptions,
+	insertMany func(ctx context.Context, collection string, docs []interface{}) error) *LogWriter {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1024
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = 5 * time.Second
+	}
+
+	w := &LogWriter{
+		db:         db,
+		opts:       opts,
+		insertMany: insertMany,
+		queue:      make(chan logEntry, opts.QueueSize),
+		done:       make(chan struct{}),
+	}
+	for i := 0; i < opts.Workers; i++ {
+		flush := make(chan chan struct{})
+		w.flush = append(w.flush, flush)
+		w.wg.Add(1)
+		go w.run(flush)
+	}
+	go func() {
+		w.wg.Wait()
+		close(w.done)
+	}()
+	return w
+}
+
+// Write 放入队列，丢弃或已关闭时返回 false
+func (w *LogWriter) Write(ctx context.Context, collection string, doc interface{}) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		w.drop(ctx, collection, ErrLogWriterClosed)
+		return false
+	}
+
+	entry := logEntry{collection: collection, doc: doc}
+	if w.opts.Overflow == LogOverflowBlock {
+		select {
+		case w.queue <- entry:
+			return true
+		case <-ctx.Done():
+			w.drop(ctx, collection, ctx.Err())
+			return false
+		}
+	}
+	select {
+	case w.queue <- entry:
+		return true
+	default:
+		w.drop(ctx, collection, errors.New("log queue is full"))
+		return false
+	}
+}
+
+func (w *LogWriter) drop(ctx context.Context, collection string, reason error) {
+	w.dropped.Add(1)
+	logEntriesTotal.WithLabelValues(collection, "dropped").Inc()
+	log.Log(ctx).WithField("collection", collection).WithError(reason).Warn("request log dropped")
+}
+
+// Dropped 返回累计丢弃的日志条数
+func (w *LogWriter) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+// Flush 写入调用前已进入队列的日志
+// 期间写入器被关闭时返回 ErrLogWriterClosed，队列中剩余的日志由 Close 写入
+func (w *LogWriter) Flush(ctx context.Context) error {
+	w.mu.RLock()
+	closed := w.closed
+	w.mu.RUnlock()
+	if closed {
+		return ErrLogWriterClosed
+	}
+
+	acks := make([]chan struct{}, 0, len(w.flush))
+	for _, flush := range w.flush {
+		ack := make(chan struct{})
+		select {
+		case flush <- ack:
+			acks = append(acks, ack)
+		case <-w.done:
+			return ErrLogWriterClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for _, ack := range acks {
+		select {
+		case <-ack:
+		case <-w.done:
+			return ErrLogWriterClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close 停止接收新日志，写完队列中剩余的日志后返回
+func (w *LogWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *LogWriter) run(flush chan chan struct{}) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]logEntry, 0, w.opts.BatchSize)
+	for {
+		select {
+		case entry, ok := <-w.queue:
+			if !ok {
+				w.insert(batch)
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) >= w.opts.BatchSize {
+				w.insert(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.insert(batch)
+			batch = batch[:0]
+		case ack := <-flush:
+			// 只处理此刻已在队列中的日志，避免持续写入时无法返回
+			// 其它协程会同时取走日志，因此不能阻塞等待
+		drain:
+			for n := len(w.queue); n > 0; n-- {
+				select {
+				case entry, ok := <-w.queue:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, entry)
+					if len(batch) >= w.opts.BatchSize {
+						w.insert(batch)
+						batch = batch[:0]
+					}
+				default:
+					break drain
+				}
+			}
+			w.insert(batch)
+			batch = batch[:0]
+			close(ack)
+		}
+	}
+}
+
+// insert 按集合分组后批量写入，失败时记录日志，不重试
+func (w *LogWriter) insert(batch []logEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	groups := map[string][]interface{}{}
+	for _, entry := range batch {
+		groups[entry.collection] = append(groups[entry.collection], entry.doc)
+	}
+
+	for collection, docs := range groups {
+		ctx, cancel := context.WithTimeout(context.Background(), w.opts.WriteTimeout)
+		err := w.insertMany(ctx, collection, docs)
+		cancel()
+
+		failed := 0
+		if err != nil {
+			// 无序写入时只有 WriteErrors 中的文档失败
+			failed = len(docs)
+			var bwe mongo.BulkWriteException
+			if errors.As(err, &bwe) && len(bwe.WriteErrors) > 0 && bwe.WriteConcernError == nil {
+				failed = len(bwe.WriteErrors)
+			}
+			logEntriesTotal.WithLabelValues(collection, "failed").Add(float64(failed))
+			log.Log(context.Background()).WithField("collection", collection).
+				WithField("count", failed).WithError(err).Error("failed to write request logs")
+		}
+		logEntriesTotal.WithLabelValues(collection, "written").Add(float64(len(docs) - failed))
+	}
+}
+
+// save 在请求协程中补全元数据后放入队列，之后不再读取请求上下文
+func (w *LogWriter) save(ctx context.Context, base *model.Model, collection string, doc interface{}) {
+	base.Init(ctx, w.db, collection)
+	base.Meta = base.GetMeta()
+	w.Write(ctx, collection, doc)
+}
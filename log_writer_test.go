@@ -0,0 +1,240 @@
+package middle
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// memoryInsert 记录写入的文档，delay 模拟 mongo 的写入耗时
+type memoryInsert struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	docs    map[string][]interface{}
+	batches chan int
+}
+
+func newMemoryInsert(delay time.Duration) *memoryInsert {
+	return &memoryInsert{delay: delay, docs: map[string][]interface{}{}, batches: make(chan int, 1024)}
+}
+
+func (m *memoryInsert) insertMany(ctx context.Context, collection string, docs []interface{}) error {
+	time.Sleep(m.delay)
+	m.mu.Lock()
+	m.docs[collection] = append(m.docs[collection], docs...)
+	m.mu.Unlock()
+	m.batches <- len(docs)
+	return nil
+}
+
+func (m *memoryInsert) count(collection string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.docs[collection])
+}
+
+// waitBatch 等待一次写入并返回条数，超时返回 0
+func (m *memoryInsert) waitBatch(timeout time.Duration) int {
+	select {
+	case n := <-m.batches:
+		return n
+	case <-time.After(timeout):
+		return 0
+	}
+}
+
+// blockingInsert 写入在调用 release 前阻塞，started 在每次写入开始时收到通知
+type blockingInsert struct {
+	started  chan struct{}
+	released chan struct{}
+	release  func()
+}
+
+func newBlockingInsert() *blockingInsert {
+	b := &blockingInsert{started: make(chan struct{}, 16), released: make(chan struct{})}
+	b.release = sync.OnceFunc(func() { close(b.released) })
+	return b
+}
+
+func (b *blockingInsert) insertMany(ctx context.Context, collection string, docs []interface{}) error {
+	b.started <- struct{}{}
+	<-b.released
+	return nil
+}
+
+func droppedMetric(collection string) float64 {
+	return testutil.ToFloat64(logEntriesTotal.WithLabelValues(collection, "dropped"))
+}
+
+func TestLogWriterMultiWorkerFlush(t *testing.T) {
+	const collection = "test_multi_worker_flush"
+	mem := newMemoryInsert(2 * time.Millisecond)
+	w := newLogWriter(nil, LogWriterOptions{Workers: 4, BatchSize: 2, FlushInterval: time.Hour}, mem.insertMany)
+	defer w.Close(context.Background())
+	written := testutil.ToFloat64(logEntriesTotal.WithLabelValues(collection, "written"))
+
+	for i := 0; i < 200; i++ {
+		if !w.Write(context.Background(), collection, i) {
+			t.Fatalf("write %d dropped", i)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Flush(ctx); err != nil {
+		t.Fatalf("flush = %v", err)
+	}
+	if n := mem.count(collection); n != 200 {
+		t.Fatalf("written = %d after flush, want 200", n)
+	}
+	if got := testutil.ToFloat64(logEntriesTotal.WithLabelValues(collection, "written")) - written; got != 200 {
+		t.Fatalf("written metric increased by %v, want 200", got)
+	}
+}
+
+func TestLogWriterBatchSize(t *testing.T) {
+	mem := newMemoryInsert(0)
+	w := newLogWriter(nil, LogWriterOptions{BatchSize: 3, FlushInterval: time.Hour}, mem.insertMany)
+	defer w.Close(context.Background())
+
+	for i := 0; i < 5; i++ {
+		w.Write(context.Background(), "test_batch_size", i)
+	}
+	if n := mem.waitBatch(time.Second); n != 3 {
+		t.Fatalf("first batch = %d, want 3", n)
+	}
+	if n := mem.waitBatch(50 * time.Millisecond); n != 0 {
+		t.Fatalf("partial batch of %d written before the interval", n)
+	}
+}
+
+func TestLogWriterFlushInterval(t *testing.T) {
+	mem := newMemoryInsert(0)
+	w := newLogWriter(nil, LogWriterOptions{BatchSize: 100, FlushInterval: 20 * time.Millisecond}, mem.insertMany)
+	defer w.Close(context.Background())
+
+	w.Write(context.Background(), "test_flush_interval", 1)
+	if n := mem.waitBatch(time.Second); n != 1 {
+		t.Fatalf("batch = %d, want 1 after the flush interval", n)
+	}
+}
+
+func TestLogWriterOverflowDrop(t *testing.T) {
+	const collection = "test_overflow_drop"
+	ins := newBlockingInsert()
+	w := newLogWriter(nil, LogWriterOptions{QueueSize: 1, BatchSize: 1, FlushInterval: time.Hour}, ins.insertMany)
+	defer w.Close(context.Background())
+	defer ins.release()
+	dropped := droppedMetric(collection)
+
+	// 第一条被写入协程取走并阻塞在写入中，第二条占满队列
+	w.Write(context.Background(), collection, 1)
+	<-ins.started
+	if !w.Write(context.Background(), collection, 2) {
+		t.Fatal("queued write dropped")
+	}
+	if w.Write(context.Background(), collection, 3) {
+		t.Fatal("write to a full queue was accepted")
+	}
+	if got := w.Dropped(); got != 1 {
+		t.Fatalf("Dropped = %d, want 1", got)
+	}
+	if got := droppedMetric(collection) - dropped; got != 1 {
+		t.Fatalf("dropped metric increased by %v, want 1", got)
+	}
+}
+
+func TestLogWriterOverflowBlock(t *testing.T) {
+	const collection = "test_overflow_block"
+	ins := newBlockingInsert()
+	w := newLogWriter(nil, LogWriterOptions{QueueSize: 1, BatchSize: 1, FlushInterval: time.Hour, Overflow: LogOverflowBlock},
+		ins.insertMany)
+	defer w.Close(context.Background())
+	defer ins.release()
+	dropped := droppedMetric(collection)
+
+	w.Write(context.Background(), collection, 1)
+	<-ins.started
+	w.Write(context.Background(), collection, 2)
+
+	// 队列已满时阻塞到 ctx 结束
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if w.Write(ctx, collection, 3) {
+		t.Fatal("write to a full queue was accepted before ctx ended")
+	}
+	if got := w.Dropped(); got != 1 {
+		t.Fatalf("Dropped = %d, want 1", got)
+	}
+	if got := droppedMetric(collection) - dropped; got != 1 {
+		t.Fatalf("dropped metric increased by %v, want 1", got)
+	}
+
+	// 有空位后继续写入
+	accepted := make(chan bool, 1)
+	go func() { accepted <- w.Write(context.Background(), collection, 4) }()
+	select {
+	case <-accepted:
+		t.Fatal("write returned while the queue was full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	ins.release()
+	select {
+	case ok := <-accepted:
+		if !ok {
+			t.Fatal("blocked write was dropped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write still blocked after the queue drained")
+	}
+}
+
+func TestLogWriterClose(t *testing.T) {
+	const collection = "test_close"
+	mem := newMemoryInsert(0)
+	w := newLogWriter(nil, LogWriterOptions{Workers: 2, FlushInterval: time.Hour}, mem.insertMany)
+	for i := 0; i < 10; i++ {
+		w.Write(context.Background(), collection, i)
+	}
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.count(collection); n != 10 {
+		t.Fatalf("written = %d after close, want 10", n)
+	}
+
+	if w.Write(context.Background(), collection, 10) {
+		t.Fatal("write after close was accepted")
+	}
+	if got := w.Dropped(); got != 1 {
+		t.Fatalf("Dropped = %d, want 1", got)
+	}
+	if err := w.Flush(context.Background()); !errors.Is(err, ErrLogWriterClosed) {
+		t.Fatalf("flush after close = %v, want %v", err, ErrLogWriterClosed)
+	}
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatalf("second close = %v", err)
+	}
+}
+
+func TestLogWriterConcurrentFlushAndClose(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		w := NewLogWriter(nil, LogWriterOptions{Workers: 4})
+		errc := make(chan error, 1)
+		go func() { errc <- w.Flush(context.Background()) }()
+		if err := w.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-errc:
+			if err != nil && !errors.Is(err, ErrLogWriterClosed) {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("flush blocked after close")
+		}
+	}
+}
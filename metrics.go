@@ -0,0 +1,155 @@
+package middle
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsNamespace 指标名称前缀
+const MetricsNamespace = "middle"
+
+// 超出租户上限或未识别租户时使用的标签值
+const (
+	MetricsTenantOther = "other"
+	MetricsRouteNone   = "unmatched"
+)
+
+// MetricsRegistry 本包指标使用的注册表，MetricsHandler 输出其中的全部指标
+var MetricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route template, method, status class and tenant.",
+	}, []string{"route", "method", "status", "tenant"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template, method, status class and tenant.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status", "tenant"})
+	authOutcomesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "auth_outcomes_total",
+		Help:      "Authentication outcomes by scheme and reason.",
+	}, []string{"scheme", "outcome"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		authOutcomesTotal,
+	)
+}
+
+// MetricsOptions 指标中间件配置
+type MetricsOptions struct {
+	// TenantLabel 为 true 时按租户区分，否则租户标签为空
+	// 租户只取自认证中间件写入的 Identity，客户端传入的 X-Tenant-ID 等头部不会占用标签
+	TenantLabel bool
+	// MaxTenants 租户标签的数量上限，超出后记为 other，0 时为 100
+	MaxTenants int
+	// Tenants 单独计数的租户，不为空时其它租户一律记为 other，MaxTenants 不再生效
+	Tenants []string
+}
+
+// MetricsMiddleware 记录请求数与耗时，需挂载在认证中间件之前
+func MetricsMiddleware(opts MetricsOptions) gin.HandlerFunc {
+	tenants := newTenantLimiter(opts.MaxTenants, opts.Tenants)
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			// 未匹配的路径不作为标签，避免被扫描请求撑爆
+			route = MetricsRouteNone
+		}
+		tenant := ""
+		if opts.TenantLabel {
+			tenant = tenants.label(tenantFromContext(c.Request.Context()))
+		}
+		labels := prometheus.Labels{
+			"route":  route,
+			"method": c.Request.Method,
+			"status": statusClass(c.Writer.Status()),
+			"tenant": tenant,
+		}
+		httpRequestsTotal.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+	}
+}
+
+// MetricsHandler 输出 MetricsRegistry 中的指标，例如 r.GET("/metrics", MetricsHandler())
+func MetricsHandler() gin.HandlerFunc {
+	h := promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{Registry: MetricsRegistry})
+	return gin.WrapH(h)
+}
+
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// recordAuthOutcome 认证结果计数，outcome 为 ok 或失败原因
+func recordAuthOutcome(scheme AuthScheme, outcome string) {
+	authOutcomesTotal.WithLabelValues(string(scheme), outcome).Inc()
+}
+
+// tenantLimiter 只为最先出现的 max 个租户单独计数
+// 指定了 allow 时只为其中的租户单独计数
+type tenantLimiter struct {
+	mu   sync.RWMutex
+	max  int
+	seen map[string]struct{}
+}
+
+func newTenantLimiter(max int, allow []string) *tenantLimiter {
+	if len(allow) > 0 {
+		seen := make(map[string]struct{}, len(allow))
+		for _, tenant := range allow {
+			seen[tenant] = struct{}{}
+		}
+		// 上限即名单本身，不再接受新的租户
+		return &tenantLimiter{max: len(seen), seen: seen}
+	}
+	if max <= 0 {
+		max = 100
+	}
+	return &tenantLimiter{max: max, seen: map[string]struct{}{}}
+}
+
+func (t *tenantLimiter) label(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+	t.mu.RLock()
+	_, ok := t.seen[tenant]
+	t.mu.RUnlock()
+	if ok {
+		return tenant
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.seen[tenant]; ok {
+		return tenant
+	}
+	if len(t.seen) >= t.max {
+		return MetricsTenantOther
+	}
+	t.seen[tenant] = struct{}{}
+	return tenant
+}
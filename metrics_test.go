@@ -0,0 +1,78 @@
+package middle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func metricsRouter(opts MetricsOptions, route string) *gin.Engine {
+	r := gin.New()
+	r.Use(MetricsMiddleware(opts))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET(route+"/bearer", JWTAuthMiddleware(testBearerSecret), ok)
+	r.GET(route+"/gateway", MerchantBindMiddleware(nil), ok)
+	return r
+}
+
+func tenantRequests(route string, tenant string) float64 {
+	return testutil.ToFloat64(httpRequestsTotal.With(prometheus.Labels{
+		"route": route, "method": http.MethodGet, "status": "2xx", "tenant": tenant,
+	}))
+}
+
+func metricsBearer(t *testing.T, r *gin.Engine, path string, tenant string) {
+	t.Helper()
+	token := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": tenant, "iss": "test", "aud": "app",
+		"exp": time.Now().Add(time.Hour).Unix(), TenantClaim: tenant})
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestMetricsTenantLabelIgnoresClientHeaders(t *testing.T) {
+	useTestRedis(t)
+	route := "/m1"
+	r := metricsRouter(MetricsOptions{TenantLabel: true, MaxTenants: 1}, route)
+
+	// 未经校验的租户头部不能占用租户标签
+	for _, tenant := range []string{"spoof1", "spoof2"} {
+		req := httptest.NewRequest(http.MethodGet, route+"/gateway", nil)
+		req.Header.Set(TenantIDHeader, tenant)
+		req.Header.Set("MerchantID", tenant)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if n := tenantRequests(route+"/gateway", ""); n != 2 {
+		t.Fatalf("unlabelled requests = %v, want 2", n)
+	}
+
+	metricsBearer(t, r, route+"/bearer", "t1")
+	metricsBearer(t, r, route+"/bearer", "t2")
+	if n := tenantRequests(route+"/bearer", "t1"); n != 1 {
+		t.Fatalf("t1 requests = %v, want 1", n)
+	}
+	if n := tenantRequests(route+"/bearer", MetricsTenantOther); n != 1 {
+		t.Fatalf("other requests = %v, want 1", n)
+	}
+}
+
+func TestMetricsTenantAllowlist(t *testing.T) {
+	useTestRedis(t)
+	route := "/m2"
+	r := metricsRouter(MetricsOptions{TenantLabel: true, Tenants: []string{"t2"}}, route)
+
+	metricsBearer(t, r, route+"/bearer", "t1")
+	metricsBearer(t, r, route+"/bearer", "t2")
+	if n := tenantRequests(route+"/bearer", "t2"); n != 1 {
+		t.Fatalf("t2 requests = %v, want 1", n)
+	}
+	if n := tenantRequests(route+"/bearer", MetricsTenantOther); n != 1 {
+		t.Fatalf("other requests = %v, want 1", n)
+	}
+}
@@ -0,0 +1,448 @@
+package middle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/open4go/log"
+	"github.com/open4go/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/yaml.v3"
+)
+
+// 规则效果
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Subject 发起请求的主体
+type Subject struct {
+	AccountID string
+	// TenantID 只来自签名 claim、内省结果或签名网关头部，不读取 X-Tenant-ID
+	// 为空时 SameTenant/Tenants 条件一律不满足
+	TenantID   string
+	Roles      []string
+	LoginLevel int
+}
+
+// Decision 鉴权结果
+type Decision struct {
+	Allowed bool
+	Reason  string
+}
+
+// Authorizer 鉴权接口，可以替换为外部策略服务
+// attrs 为请求相关的属性，例如 "tenant" 为被访问数据所属租户
+type Authorizer interface {
+	Authorize(ctx context.Context, sub Subject, action string, resource string, attrs map[string]string) (Decision, error)
+}
+
+// Policy 策略文件的结构，yaml/json/mongo 共用
+//
+//	roles:
+//	  - name: staff
+//	    rules:
+//	      - actions: [GET]
+//	        resources: [/v1/orders/**]
+//	        conditions: {same_tenant: true}
+//	  - name: manager
+//	    inherits: [staff]
+//	    rules:
+//	      - actions: ["*"]
+//	        resources: [/v1/orders/**]
+//	        conditions: {min_login_level: 2, time_of_day: {from: "08:00", to: "22:00"}}
+type Policy struct {
+	Roles []RolePolicy `json:"roles" yaml:"roles" bson:"roles"`
+}
+
+// RolePolicy 一个角色及其规则，mongo 中每个角色一个文档
+type RolePolicy struct {
+	Name     string   `json:"name" yaml:"name" bson:"name"`
+	Inherits []string `json:"inherits,omitempty" yaml:"inherits,omitempty" bson:"inherits,omitempty"`
+	Rules    []Rule   `json:"rules" yaml:"rules" bson:"rules"`
+}
+
+// Rule 一条规则，resources 支持 * 匹配一级路径，末尾的 /** 匹配任意层级
+type Rule struct {
+	Effect     string     `json:"effect,omitempty" yaml:"effect,omitempty" bson:"effect,omitempty"`
+	Actions    []string   `json:"actions" yaml:"actions" bson:"actions"`
+	Resources  []string   `json:"resources" yaml:"resources" bson:"resources"`
+	Conditions Conditions `json:"conditions,omitempty" yaml:"conditions,omitempty" bson:"conditions,omitempty"`
+}
+
+// Conditions 属性条件，全部满足时规则才生效
+type Conditions struct {
+	// SameTenant 主体租户必须与 attrs["tenant"] 相同
+	SameTenant bool `json:"same_tenant,omitempty" yaml:"same_tenant,omitempty" bson:"same_tenant,omitempty"`
+	// Tenants 主体租户必须在列表中
+	Tenants []string `json:"tenants,omitempty" yaml:"tenants,omitempty" bson:"tenants,omitempty"`
+	// MinLoginLevel 主体 LoginLevel 不低于该值
+	MinLoginLevel int `json:"min_login_level,omitempty" yaml:"min_login_level,omitempty" bson:"min_login_level,omitempty"`
+	// TimeOfDay 只在该时间段内生效
+	TimeOfDay *TimeWindow `json:"time_of_day,omitempty" yaml:"time_of_day,omitempty" bson:"time_of_day,omitempty"`
+}
+
+// TimeWindow 每天的时间段，格式 15:04，To 小于 From 时表示跨天
+type TimeWindow struct {
+	From     string `json:"from" yaml:"from" bson:"from"`
+	To       string `json:"to" yaml:"to" bson:"to"`
+	Location string `json:"location,omitempty" yaml:"location,omitempty" bson:"location,omitempty"`
+
+	// 由 compile 在加载策略时解析，未解析的时间段不匹配任何时间
+	from, to time.Duration
+	loc      *time.Location
+}
+
+// PolicyEngine 内置的策略引擎，支持角色继承、通配路径与属性条件
+// deny 规则优先于 allow 规则
+type PolicyEngine struct {
+	mu    sync.RWMutex
+	roles map[string]RolePolicy
+	// Now 当前时间，便于测试注入，默认 time.Now
+	Now func() time.Time
+}
+
+// NewPolicyEngine 创建策略引擎
+func NewPolicyEngine(p Policy) (*PolicyEngine, error) {
+	e := &PolicyEngine{}
+	if err := e.Update(p); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Update 整体替换策略
+func (e *PolicyEngine) Update(p Policy) error {
+	roles, err := compilePolicy(p)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.roles = roles
+	e.mu.Unlock()
+	return nil
+}
+
+// compilePolicy 校验策略并解析时间段，返回的规则不与 p 共享内存
+func compilePolicy(p Policy) (map[string]RolePolicy, error) {
+	roles := make(map[string]RolePolicy, len(p.Roles))
+	for _, r := range p.Roles {
+		if r.Name == "" {
+			return nil, errors.New("policy role without name")
+		}
+		rules := make([]Rule, len(r.Rules))
+		for i, rule := range r.Rules {
+			if rule.Effect != "" && rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+				return nil, fmt.Errorf("role %q: unknown effect %q", r.Name, rule.Effect)
+			}
+			if rule.Conditions.TimeOfDay != nil {
+				w, err := rule.Conditions.TimeOfDay.compile()
+				if err != nil {
+					return nil, fmt.Errorf("role %q: %w", r.Name, err)
+				}
+				rule.Conditions.TimeOfDay = w
+			}
+			rules[i] = rule
+		}
+		r.Rules = rules
+		roles[r.Name] = r
+	}
+	// 检查继承是否存在环
+	for name := range roles {
+		if err := checkInheritance(roles, name, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+	return roles, nil
+}
+
+func checkInheritance(roles map[string]RolePolicy, name string, visiting map[string]bool) error {
+	if visiting[name] {
+		return fmt.Errorf("role inheritance cycle at %q", name)
+	}
+	visiting[name] = true
+	for _, parent := range roles[name].Inherits {
+		if err := checkInheritance(roles, parent, visiting); err != nil {
+			return err
+		}
+	}
+	delete(visiting, name)
+	return nil
+}
+
+// Authorize 实现 Authorizer
+func (e *PolicyEngine) Authorize(ctx context.Context, sub Subject, action string, resource string, attrs map[string]string) (Decision, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	now := time.Now()
+	if e.Now != nil {
+		now = e.Now()
+	}
+
+	allowed := false
+	for _, role := range e.expandRoles(sub.Roles) {
+		for _, rule := range e.roles[role].Rules {
+			if !matchAny(rule.Actions, action, matchAction) || !matchAny(rule.Resources, resource, matchResource) {
+				continue
+			}
+			if !rule.Conditions.satisfied(sub, attrs, now) {
+				continue
+			}
+			if rule.Effect == EffectDeny {
+				return Decision{Reason: fmt.Sprintf("denied by role %q", role)}, nil
+			}
+			allowed = true
+		}
+	}
+	if !allowed {
+		return Decision{Reason: "no rule allows this action"}, nil
+	}
+	return Decision{Allowed: true}, nil
+}
+
+// expandRoles 展开继承的角色
+func (e *PolicyEngine) expandRoles(roles []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	var walk func(string)
+	walk = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		out = append(out, name)
+		for _, parent := range e.roles[name].Inherits {
+			walk(parent)
+		}
+	}
+	for _, r := range roles {
+		walk(r)
+	}
+	return out
+}
+
+func (c Conditions) satisfied(sub Subject, attrs map[string]string, now time.Time) bool {
+	if c.SameTenant && (sub.TenantID == "" || sub.TenantID != attrs["tenant"]) {
+		return false
+	}
+	if len(c.Tenants) > 0 && (sub.TenantID == "" || !containsString(c.Tenants, sub.TenantID)) {
+		return false
+	}
+	if c.MinLoginLevel > 0 && sub.LoginLevel < c.MinLoginLevel {
+		return false
+	}
+	if c.TimeOfDay != nil && !c.TimeOfDay.contains(now) {
+		return false
+	}
+	return true
+}
+
+// compile 返回解析好的副本
+func (w *TimeWindow) compile() (*TimeWindow, error) {
+	from, err := time.Parse("15:04", w.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time_of_day.from %q", w.From)
+	}
+	to, err := time.Parse("15:04", w.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time_of_day.to %q", w.To)
+	}
+	loc := time.Local
+	if w.Location != "" {
+		if loc, err = time.LoadLocation(w.Location); err != nil {
+			return nil, fmt.Errorf("invalid time_of_day.location %q: %w", w.Location, err)
+		}
+	}
+	c := *w
+	c.from = time.Duration(from.Hour())*time.Hour + time.Duration(from.Minute())*time.Minute
+	c.to = time.Duration(to.Hour())*time.Hour + time.Duration(to.Minute())*time.Minute
+	c.loc = loc
+	return &c, nil
+}
+
+func (w *TimeWindow) contains(t time.Time) bool {
+	if w.loc == nil {
+		return false
+	}
+	t = t.In(w.loc)
+	now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.from <= w.to {
+		return now >= w.from && now < w.to
+	}
+	// 跨天，例如 22:00 - 06:00
+	return now >= w.from || now < w.to
+}
+
+func matchAny(patterns []string, value string, match func(string, string) bool) bool {
+	for _, p := range patterns {
+		if match(p, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAction(pattern string, action string) bool {
+	return pattern == "*" || strings.EqualFold(pattern, action)
+}
+
+// matchResource * 匹配一级路径，末尾的 /** 匹配任意层级(包括自身)
+func matchResource(pattern string, resource string) bool {
+	if pattern == "*" || pattern == "/**" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return matchSegments(prefix, resource, true)
+	}
+	return matchSegments(pattern, resource, false)
+}
+
+func matchSegments(pattern string, resource string, prefixOnly bool) bool {
+	ps := strings.Split(pattern, "/")
+	rs := strings.Split(resource, "/")
+	if len(rs) < len(ps) || (!prefixOnly && len(rs) != len(ps)) {
+		return false
+	}
+	for i, p := range ps {
+		if p != "*" && p != rs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadPolicyFile 按扩展名从 yaml/json 文件加载策略，策略无效时返回错误
+func LoadPolicyFile(path string) (Policy, error) {
+	var p Policy
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &p)
+	case ".json":
+		err = json.Unmarshal(data, &p)
+	default:
+		err = fmt.Errorf("unsupported policy file type %q", path)
+	}
+	if err != nil {
+		return p, err
+	}
+	_, err = compilePolicy(p)
+	return p, err
+}
+
+// LoadPolicyFromMongo 从 mongo 集合加载策略，每个文档为一个 RolePolicy，策略无效时返回错误
+func LoadPolicyFromMongo(ctx context.Context, db *mongo.Database, collection string) (Policy, error) {
+	var p Policy
+	cursor, err := db.Collection(collection).Find(ctx, bson.D{})
+	if err != nil {
+		return p, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &p.Roles); err != nil {
+		return p, err
+	}
+	_, err = compilePolicy(p)
+	return p, err
+}
+
+type authorizerKey struct{}
+
+// ErrNotAuthenticated 请求上下文中没有登陆身份
+var ErrNotAuthenticated = errors.New("request is not authenticated")
+
+// DefaultAuthorizer 没有挂载 AuthorizeMiddleware 时 Can 使用的鉴权器
+var DefaultAuthorizer Authorizer
+
+// AuthorizeMiddleware 使用 a 对 请求方法 + c.FullPath() 鉴权，需挂载在认证中间件之后
+// 同时将 a 放入请求上下文，供处理函数中的 Can 使用
+// 没有登陆身份时返回 401，无法读取角色时返回 503
+func AuthorizeMiddleware(a Authorizer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.WithValue(c.Request.Context(), authorizerKey{}, a)
+		c.Request = c.Request.WithContext(ctx)
+
+		d, err := authorize(ctx, a, c.Request.Method, c.FullPath())
+		if errors.Is(err, ErrNotAuthenticated) {
+			abortAuth(c, AuthCodeUnauthenticated, err.Error())
+			return
+		}
+		if err != nil {
+			log.Log(ctx).WithError(err).Error("Failed to authorize request")
+			abortUnavailable(c, AuthCodeAuthorizationUnavailable, "authorization is unavailable")
+			return
+		}
+		if !d.Allowed {
+			log.Log(ctx).WithField("path", c.FullPath()).
+				WithField("reason", d.Reason).Warn("request denied by policy")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden", "reason": d.Reason})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Can 在处理函数中判断当前登陆账号能否对 resource 执行 action
+func Can(ctx context.Context, action string, resource string) bool {
+	a, ok := ctx.Value(authorizerKey{}).(Authorizer)
+	if !ok {
+		a = DefaultAuthorizer
+	}
+	if a == nil {
+		log.Log(ctx).Error("no authorizer configured")
+		return false
+	}
+	d, err := authorize(ctx, a, action, resource)
+	if err != nil {
+		log.Log(ctx).WithError(err).Error("Failed to authorize")
+		return false
+	}
+	return d.Allowed
+}
+
+func authorize(ctx context.Context, a Authorizer, action string, resource string) (Decision, error) {
+	sub, err := SubjectFromContext(ctx)
+	if err != nil {
+		return Decision{}, err
+	}
+	tenant, _ := ctx.Value(model.MerchantKey).(string)
+	return a.Authorize(ctx, sub, action, resource, map[string]string{"tenant": tenant})
+}
+
+// SubjectFromContext 根据 Identity 构建主体，角色来自 SetAccountRoles 写入的集合
+func SubjectFromContext(ctx context.Context) (Subject, error) {
+	l, ok := Identity(ctx)
+	if !ok || l.AccountID == "" {
+		return Subject{}, ErrNotAuthenticated
+	}
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return Subject{}, err
+	}
+	roles, err := handler.SMembers(ctx, RBACAccountRolesKeyPrefix+l.AccountID).Result()
+	if err != nil {
+		return Subject{}, err
+	}
+	level, _ := strconv.Atoi(l.LoginLevel)
+	return Subject{
+		AccountID:  l.AccountID,
+		TenantID:   l.MerchantID,
+		Roles:      roles,
+		LoginLevel: level,
+	}, nil
+}
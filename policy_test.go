@@ -0,0 +1,177 @@
+package middle
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+func sameTenantPolicy(t *testing.T) *PolicyEngine {
+	t.Helper()
+	e, err := NewPolicyEngine(Policy{Roles: []RolePolicy{{
+		Name: "staff",
+		Rules: []Rule{{
+			Actions:    []string{"GET"},
+			Resources:  []string{"/res"},
+			Conditions: Conditions{SameTenant: true},
+		}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestPolicyRejectsForeignTenantHeader(t *testing.T) {
+	useTestRedis(t)
+	if err := SetAccountRoles(context.Background(), "acct", "staff"); err != nil {
+		t.Fatal(err)
+	}
+	engine := sameTenantPolicy(t)
+	h := func(c *gin.Context) {
+		JWTAuthMiddleware(testBearerSecret)(c)
+		if !c.IsAborted() {
+			AuthorizeMiddleware(engine)(c)
+		}
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	unscoped := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": "j1", "iss": "test", "aud": "app", "exp": exp})
+	scoped := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": "j2", "iss": "test", "aud": "app", "exp": exp, TenantClaim: "t1"})
+
+	cases := []struct {
+		name   string
+		token  string
+		tenant string
+		want   int
+	}{
+		{"no tenant claim, foreign header", unscoped, "t2", http.StatusForbidden},
+		{"no tenant claim, no header", unscoped, "", http.StatusForbidden},
+		{"tenant claim, foreign header", scoped, "t2", http.StatusForbidden},
+		{"tenant claim, own header", scoped, "t1", http.StatusOK},
+		{"tenant claim, no header", scoped, "", http.StatusOK},
+	}
+	for _, tc := range cases {
+		header := http.Header{}
+		if tc.tenant != "" {
+			header.Set(TenantIDHeader, tc.tenant)
+		}
+		if code, _ := bearerRequest(t, h, tc.token, header); code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, code, tc.want)
+		}
+	}
+}
+
+func TestTenantConditionsFailClosed(t *testing.T) {
+	now := time.Now()
+	sub := Subject{AccountID: "acct"}
+	if (Conditions{SameTenant: true}).satisfied(sub, map[string]string{"tenant": ""}, now) {
+		t.Error("same_tenant satisfied without a verified tenant")
+	}
+	if (Conditions{Tenants: []string{""}}).satisfied(sub, nil, now) {
+		t.Error("tenants satisfied without a verified tenant")
+	}
+	sub.TenantID = "t1"
+	if !(Conditions{SameTenant: true, Tenants: []string{"t1"}}).satisfied(sub, map[string]string{"tenant": "t1"}, now) {
+		t.Error("matching tenant rejected")
+	}
+}
+
+func TestTimeWindowParsedOnce(t *testing.T) {
+	window := &TimeWindow{From: "22:00", To: "06:00", Location: "Asia/Shanghai"}
+	p := Policy{Roles: []RolePolicy{{
+		Name:  "night",
+		Rules: []Rule{{Actions: []string{"GET"}, Resources: []string{"/res"}, Conditions: Conditions{TimeOfDay: window}}},
+	}}}
+	e, err := NewPolicyEngine(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if window.loc != nil {
+		t.Fatal("Update modified the caller's time window")
+	}
+
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	sub := Subject{AccountID: "acct", Roles: []string{"night"}}
+	cases := []struct {
+		at   time.Time
+		want bool
+	}{
+		{time.Date(2024, 1, 1, 21, 59, 0, 0, shanghai), false},
+		{time.Date(2024, 1, 1, 22, 0, 0, 0, shanghai), true},
+		{time.Date(2024, 1, 2, 5, 59, 0, 0, shanghai), true},
+		{time.Date(2024, 1, 2, 6, 0, 0, 0, shanghai), false},
+		// 同一时刻换成 UTC 表示，仍按 Location 计算
+		{time.Date(2024, 1, 1, 15, 0, 0, 0, time.UTC), true},
+	}
+	for _, tc := range cases {
+		e.Now = func() time.Time { return tc.at }
+		d, err := e.Authorize(context.Background(), sub, "GET", "/res", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Allowed != tc.want {
+			t.Errorf("at %s: allowed = %v, want %v", tc.at, d.Allowed, tc.want)
+		}
+	}
+
+	if (&TimeWindow{From: "00:00", To: "23:59"}).contains(time.Now()) {
+		t.Error("unparsed time window matched")
+	}
+}
+
+func TestInvalidTimeWindowRejected(t *testing.T) {
+	windows := []TimeWindow{
+		{From: "8:00pm", To: "22:00"},
+		{From: "08:00", To: "24:30"},
+		{From: "08:00", To: "22:00", Location: "Mars/Olympus"},
+	}
+	for _, w := range windows {
+		p := Policy{Roles: []RolePolicy{{
+			Name:  "staff",
+			Rules: []Rule{{Actions: []string{"GET"}, Resources: []string{"/res"}, Conditions: Conditions{TimeOfDay: &w}}},
+		}}}
+		if _, err := NewPolicyEngine(p); err == nil {
+			t.Errorf("%+v: NewPolicyEngine accepted invalid window", w)
+		}
+
+		path := filepath.Join(t.TempDir(), "policy.json")
+		data, _ := json.Marshal(p)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPolicyFile(path); err == nil {
+			t.Errorf("%+v: LoadPolicyFile accepted invalid window", w)
+		}
+	}
+}
+
+func TestAuthorizeMiddlewareStatus(t *testing.T) {
+	mr := useTestRedis(t)
+	engine := sameTenantPolicy(t)
+	h := func(c *gin.Context) {
+		JWTAuthMiddleware(testBearerSecret)(c)
+		if !c.IsAborted() {
+			AuthorizeMiddleware(engine)(c)
+		}
+	}
+	token := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": "j1", "iss": "test", "aud": "app",
+		"exp": time.Now().Add(time.Hour).Unix(), TenantClaim: "t1"})
+
+	if code, reason := bearerRequest(t, AuthorizeMiddleware(engine), token, nil); code != http.StatusUnauthorized || reason != AuthCodeUnauthenticated {
+		t.Errorf("no identity: got %d %q, want 401 %q", code, reason, AuthCodeUnauthenticated)
+	}
+
+	if err := mr.Set(RBACAccountRolesKeyPrefix+"acct", "not-a-set"); err != nil {
+		t.Fatal(err)
+	}
+	if code, reason := bearerRequest(t, h, token, nil); code != http.StatusServiceUnavailable || reason != AuthCodeAuthorizationUnavailable {
+		t.Errorf("store error: got %d %q, want 503 %q", code, reason, AuthCodeAuthorizationUnavailable)
+	}
+}
@@ -0,0 +1,246 @@
+package middle
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/open4go/log"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// RBACRouteKeyPrefix 路由权限 hash，key 为 "方法 路径"，field 为角色，value 为 true/false
+	// 例如 hget "rbac:route:GET /v1/system/user" admin => true
+	RBACRouteKeyPrefix = "rbac:route:"
+	// RBACRouteIndexKey 已写入的路由 key，便于整体替换
+	RBACRouteIndexKey = "rbac:routes"
+	// RBACAccountRolesKeyPrefix 账号拥有的角色集合
+	RBACAccountRolesKeyPrefix = "rbac:account:roles:"
+	// RBACAnyRole 允许任意已登陆账号访问
+	RBACAnyRole = "*"
+)
+
+// EnableRouteRBAC 为 true 时 JWTMiddleware 在校验 token 后检查路由权限
+var EnableRouteRBAC = false
+
+// RBACCacheTTL 进程内缓存权限判断结果的时间
+var RBACCacheTTL = 30 * time.Second
+
+// 安全事件类型
+const (
+	SecurityEventRouteDenied = "route_denied"
+)
+
+// 拒绝原因
+const (
+	RBACReasonNoRoles      = "account has no roles"
+	RBACReasonUnknownRoute = "route is not covered by policy"
+	RBACReasonDenied       = "no role grants access to this route"
+)
+
+// RoutePermission 一条路由权限
+type RoutePermission struct {
+	Method string   `json:"method"`
+	Path   string   `json:"path"`
+	Roles  []string `json:"roles"`
+}
+
+type rbacDecision struct {
+	allowed bool
+	reason  string
+	expires time.Time
+}
+
+const rbacCacheMaxEntries = 10000
+
+var rbacCache = struct {
+	sync.RWMutex
+	entries map[string]rbacDecision
+}{entries: map[string]rbacDecision{}}
+
+func routeKey(method string, path string) string {
+	return RBACRouteKeyPrefix + strings.ToUpper(method) + " " + path
+}
+
+// AuthorizeRoute 判断账号是否可以访问路由，拒绝时返回原因
+func AuthorizeRoute(ctx context.Context, accountID string, method string, path string) (bool, string, error) {
+	cacheKey := accountID + "|" + method + "|" + path
+	now := time.Now()
+
+	rbacCache.RLock()
+	d, ok := rbacCache.entries[cacheKey]
+	rbacCache.RUnlock()
+	if ok && now.Before(d.expires) {
+		return d.allowed, d.reason, nil
+	}
+
+	allowed, reason, err := authorizeRoute(ctx, accountID, method, path)
+	if err != nil {
+		return false, "", err
+	}
+
+	rbacCache.Lock()
+	if len(rbacCache.entries) >= rbacCacheMaxEntries {
+		// 简单地整体清空，避免缓存无限增长
+		rbacCache.entries = map[string]rbacDecision{}
+	}
+	rbacCache.entries[cacheKey] = rbacDecision{allowed: allowed, reason: reason, expires: now.Add(RBACCacheTTL)}
+	rbacCache.Unlock()
+	return allowed, reason, nil
+}
+
+func authorizeRoute(ctx context.Context, accountID string, method string, path string) (bool, string, error) {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return false, "", err
+	}
+	roles, err := handler.SMembers(ctx, RBACAccountRolesKeyPrefix+accountID).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return false, "", err
+	}
+
+	fields := append([]string{RBACAnyRole}, roles...)
+	values, err := handler.HMGet(ctx, routeKey(method, path), fields...).Result()
+	if err != nil {
+		return false, "", err
+	}
+
+	covered := false
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		covered = true
+		if s == "true" || s == "1" {
+			return true, "", nil
+		}
+	}
+	if len(roles) == 0 {
+		return false, RBACReasonNoRoles, nil
+	}
+	if !covered {
+		// 进一步确认路由是否存在于策略中
+		n, err := handler.Exists(ctx, routeKey(method, path)).Result()
+		if err != nil {
+			return false, "", err
+		}
+		if n == 0 {
+			return false, RBACReasonUnknownRoute, nil
+		}
+	}
+	return false, RBACReasonDenied, nil
+}
+
+// authorizeRequest JWTMiddleware 中的鉴权步骤，拒绝时返回 403 以及原因，策略不可用时返回 503
+func authorizeRequest(c *gin.Context, accountID string) bool {
+	allowed, reason, err := AuthorizeRoute(c.Request.Context(), accountID, c.Request.Method, c.FullPath())
+	if err != nil {
+		log.Log(c.Request.Context()).WithError(err).Error("Failed to authorize route")
+		abortUnavailable(c, AuthCodeAuthorizationUnavailable, "authorization is unavailable")
+		return false
+	}
+	if !allowed {
+		recordAuthFailure(c, AuthCodeRouteDenied)
+		emitSecurityEvent(c.Request.Context(), SecurityEvent{
+			Type:      SecurityEventRouteDenied,
+			AccountID: accountID,
+			ClientIP:  c.ClientIP(),
+			Detail:    map[string]string{"method": c.Request.Method, "path": c.FullPath(), "reason": reason},
+		})
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden", "reason": reason})
+		return false
+	}
+	return true
+}
+
+// SetAccountRoles 替换账号的角色，通常在登陆或修改角色后调用
+func SetAccountRoles(ctx context.Context, accountID string, roles ...string) error {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return err
+	}
+	key := RBACAccountRolesKeyPrefix + accountID
+	pipe := handler.TxPipeline()
+	pipe.Del(ctx, key)
+	if len(roles) > 0 {
+		members := make([]interface{}, len(roles))
+		for i, r := range roles {
+			members[i] = r
+		}
+		pipe.SAdd(ctx, key, members...)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	InvalidateRBACCache()
+	return nil
+}
+
+// LoadRBACPolicy 使用 rules 整体替换 redis 中的路由权限
+func LoadRBACPolicy(ctx context.Context, rules []RoutePermission) error {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return err
+	}
+	old, err := handler.SMembers(ctx, RBACRouteIndexKey).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	pipe := handler.TxPipeline()
+	for _, key := range old {
+		pipe.Del(ctx, key)
+	}
+	pipe.Del(ctx, RBACRouteIndexKey)
+	for _, rule := range rules {
+		key := routeKey(rule.Method, rule.Path)
+		for _, role := range rule.Roles {
+			pipe.HSet(ctx, key, role, "true")
+		}
+		pipe.SAdd(ctx, RBACRouteIndexKey, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	InvalidateRBACCache()
+	return nil
+}
+
+// InvalidateRBACCache 清空本进程的权限缓存
+// 其它实例的缓存会在 RBACCacheTTL 后自然失效
+func InvalidateRBACCache() {
+	rbacCache.Lock()
+	rbacCache.entries = map[string]rbacDecision{}
+	rbacCache.Unlock()
+}
+
+// LoadRBACPolicyHandler 管理接口，body 为 []RoutePermission
+func LoadRBACPolicyHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var rules []RoutePermission
+		if err := c.ShouldBindJSON(&rules); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := LoadRBACPolicy(c.Request.Context(), rules); err != nil {
+			log.Log(c.Request.Context()).WithError(err).Error("Failed to load rbac policy")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load policy"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"routes": len(rules)})
+	}
+}
+
+// InvalidateRBACCacheHandler 管理接口，清空本进程的权限缓存
+func InvalidateRBACCacheHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		InvalidateRBACCache()
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,184 @@
+package middle
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func useRBAC(t *testing.T) {
+	t.Helper()
+	EnableRouteRBAC = true
+	InvalidateRBACCache()
+	t.Cleanup(func() {
+		EnableRouteRBAC = false
+		InvalidateRBACCache()
+	})
+}
+
+// captureSecurityEvents 记录测试期间的安全事件
+func captureSecurityEvents(t *testing.T) func() []SecurityEvent {
+	t.Helper()
+	var mu sync.Mutex
+	var events []SecurityEvent
+	OnSecurityEvent = func(_ context.Context, e SecurityEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+	t.Cleanup(func() { OnSecurityEvent = nil })
+	return func() []SecurityEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]SecurityEvent(nil), events...)
+	}
+}
+
+func TestAuthorizeRoute(t *testing.T) {
+	useTestRedis(t)
+	useRBAC(t)
+	ctx := context.Background()
+	err := LoadRBACPolicy(ctx, []RoutePermission{
+		{Method: "GET", Path: "/users", Roles: []string{"admin", "viewer"}},
+		{Method: "DELETE", Path: "/users/:id", Roles: []string{"admin"}},
+		{Method: "GET", Path: "/profile", Roles: []string{RBACAnyRole}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetAccountRoles(ctx, "alice", "viewer"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		account, method, path string
+		allowed               bool
+		reason                string
+	}{
+		{"alice", "GET", "/users", true, ""},
+		{"alice", "get", "/users", true, ""},
+		{"alice", "DELETE", "/users/:id", false, RBACReasonDenied},
+		{"alice", "GET", "/orders", false, RBACReasonUnknownRoute},
+		{"alice", "GET", "/profile", true, ""},
+		{"bob", "GET", "/users", false, RBACReasonNoRoles},
+		{"bob", "GET", "/profile", true, ""},
+	}
+	for _, tc := range cases {
+		allowed, reason, err := AuthorizeRoute(ctx, tc.account, tc.method, tc.path)
+		if err != nil || allowed != tc.allowed || reason != tc.reason {
+			t.Fatalf("%s %s %s = %v %q %v, want %v %q", tc.account, tc.method, tc.path,
+				allowed, reason, err, tc.allowed, tc.reason)
+		}
+	}
+}
+
+func TestAuthorizeRouteCache(t *testing.T) {
+	mr := useTestRedis(t)
+	useRBAC(t)
+	ctx := context.Background()
+	if err := LoadRBACPolicy(ctx, []RoutePermission{{Method: "GET", Path: "/users", Roles: []string{"admin"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetAccountRoles(ctx, "alice", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if allowed, _, _ := AuthorizeRoute(ctx, "alice", "GET", "/users"); !allowed {
+		t.Fatal("admin should be allowed")
+	}
+
+	// 直接修改 redis 不会影响缓存中的结果
+	mr.Del(RBACAccountRolesKeyPrefix + "alice")
+	if allowed, _, _ := AuthorizeRoute(ctx, "alice", "GET", "/users"); !allowed {
+		t.Fatal("cached decision should still allow")
+	}
+
+	// SetAccountRoles 清空缓存
+	if err := SetAccountRoles(ctx, "alice", "viewer"); err != nil {
+		t.Fatal(err)
+	}
+	if allowed, reason, _ := AuthorizeRoute(ctx, "alice", "GET", "/users"); allowed || reason != RBACReasonDenied {
+		t.Fatalf("after role change = %v %q, want denied", allowed, reason)
+	}
+}
+
+func TestLoadRBACPolicyReplacesRoutes(t *testing.T) {
+	mr := useTestRedis(t)
+	useRBAC(t)
+	ctx := context.Background()
+	if err := LoadRBACPolicy(ctx, []RoutePermission{{Method: "GET", Path: "/old", Roles: []string{"admin"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadRBACPolicy(ctx, []RoutePermission{{Method: "GET", Path: "/new", Roles: []string{"admin"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(routeKey("GET", "/old")) {
+		t.Fatal("old route key should be removed")
+	}
+	members, err := mr.Members(RBACRouteIndexKey)
+	if err != nil || len(members) != 1 || members[0] != routeKey("GET", "/new") {
+		t.Fatalf("route index = %v, %v", members, err)
+	}
+	if err := SetAccountRoles(ctx, "alice", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if allowed, reason, _ := AuthorizeRoute(ctx, "alice", "GET", "/old"); allowed || reason != RBACReasonUnknownRoute {
+		t.Fatalf("old route = %v %q", allowed, reason)
+	}
+}
+
+func TestJWTMiddlewareRouteRBAC(t *testing.T) {
+	mr := useTestRedis(t)
+	useRBAC(t)
+	events := captureSecurityEvents(t)
+	ctx := context.Background()
+	secret := []byte("cookie-secret")
+	cookie := sessionCookie(t, StaticKeyring(secret))
+	if err := LoadRBACPolicy(ctx, []RoutePermission{{Method: "GET", Path: "/users/:id", Roles: []string{"admin"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.GET("/users/:id", JWTMiddleware(secret), func(c *gin.Context) { c.Status(http.StatusOK) })
+	request := func() (int, map[string]string) {
+		req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		body := map[string]string{}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	code, body := request()
+	if code != http.StatusForbidden || body["reason"] != RBACReasonNoRoles {
+		t.Fatalf("got %d %v, want 403 %q", code, body, RBACReasonNoRoles)
+	}
+	got := events()
+	if len(got) != 1 || got[0].Type != SecurityEventRouteDenied || got[0].AccountID != "acct" ||
+		got[0].Detail["reason"] != RBACReasonNoRoles || got[0].Detail["path"] != "/users/:id" {
+		t.Fatalf("events = %+v", got)
+	}
+
+	if err := SetAccountRoles(ctx, "acct", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := request(); code != http.StatusOK {
+		t.Fatalf("admin status = %d, want 200", code)
+	}
+
+	// 策略读取失败时返回 503，而不是 403
+	InvalidateRBACCache()
+	mr.Del(RBACAccountRolesKeyPrefix + "acct")
+	if err := mr.Set(RBACAccountRolesKeyPrefix+"acct", "not-a-set"); err != nil {
+		t.Fatal(err)
+	}
+	code, body = request()
+	if code != http.StatusServiceUnavailable || body["code"] != AuthCodeAuthorizationUnavailable {
+		t.Fatalf("got %d %v, want 503 %q", code, body, AuthCodeAuthorizationUnavailable)
+	}
+}
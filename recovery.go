@@ -0,0 +1,172 @@
+package middle
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open4go/log"
+)
+
+const (
+	// RecoveryCodeHeader 使用恢复码代替 TOTP 验证码
+	RecoveryCodeHeader = "X-Recovery-Code"
+	// RecoveryCodesKeyPrefix 账号的恢复码摘要集合
+	// 与使用记录分属不同的命名空间，避免形如 "audit:x" 的账号与账号 x 的记录冲突
+	RecoveryCodesKeyPrefix = "2fa:recovery:codes:"
+	// RecoveryAuditKeyPrefix 恢复码使用记录
+	RecoveryAuditKeyPrefix = "2fa:recovery:audit:"
+	// DefaultRecoveryCodeCount 默认生成的恢复码数量
+	DefaultRecoveryCodeCount = 10
+	// 每个账号保留的使用记录条数
+	recoveryAuditLimit = 100
+)
+
+// 安全事件类型
+const (
+	SecurityEventRecoveryCodeUsed = "recovery_code_used"
+)
+
+// ErrRecoveryCodesExist 账号已有恢复码，需要使用 RegenerateRecoveryCodes
+var ErrRecoveryCodesExist = errors.New("recovery codes already exist")
+
+// RecoveryAuditEntry 恢复码使用记录
+type RecoveryAuditEntry struct {
+	AccountID string    `json:"account_id"`
+	ClientIP  string    `json:"client_ip"`
+	Remaining int64     `json:"remaining"`
+	Time      time.Time `json:"time"`
+}
+
+// GenerateRecoveryCodes 为账号生成一次性恢复码，明文只在此时返回，服务端仅保存摘要
+// 账号已有恢复码时返回 ErrRecoveryCodesExist
+func GenerateRecoveryCodes(ctx context.Context, accountID string, n int) ([]string, error) {
+	count, err := RemainingRecoveryCodes(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrRecoveryCodesExist
+	}
+	return RegenerateRecoveryCodes(ctx, accountID, n)
+}
+
+// RegenerateRecoveryCodes 作废旧的恢复码并生成新的一组
+func RegenerateRecoveryCodes(ctx context.Context, accountID string, n int) ([]string, error) {
+	if accountID == "" {
+		return nil, errors.New("accountID is required")
+	}
+	if n <= 0 {
+		n = DefaultRecoveryCodeCount
+	}
+
+	codes := make([]string, n)
+	hashes := make([]interface{}, n)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		hashes[i] = hashRecoveryCode(accountID, code)
+	}
+
+	key := RecoveryCodesKeyPrefix + accountID
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pipe := handler.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.SAdd(ctx, key, hashes...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RemainingRecoveryCodes 返回未使用的恢复码数量
+func RemainingRecoveryCodes(ctx context.Context, accountID string) (int64, error) {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return handler.SCard(ctx, RecoveryCodesKeyPrefix+accountID).Result()
+}
+
+// consumeRecoveryCode 校验并作废恢复码，成功时写入使用记录
+func consumeRecoveryCode(ctx context.Context, accountID string, code string, clientIP string) (bool, error) {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return false, err
+	}
+	key := RecoveryCodesKeyPrefix + accountID
+	removed, err := handler.SRem(ctx, key, hashRecoveryCode(accountID, code)).Result()
+	if err != nil || removed == 0 {
+		return false, err
+	}
+
+	remaining, _ := handler.SCard(ctx, key).Result()
+	entry := RecoveryAuditEntry{AccountID: accountID, ClientIP: clientIP, Remaining: remaining, Time: time.Now()}
+	payload, _ := json.Marshal(entry)
+	pipe := handler.TxPipeline()
+	pipe.LPush(ctx, RecoveryAuditKeyPrefix+accountID, payload)
+	pipe.LTrim(ctx, RecoveryAuditKeyPrefix+accountID, 0, recoveryAuditLimit-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		// 恢复码已作废，记录失败不影响本次验证
+		log.Log(ctx).WithField("accountId", accountID).WithError(err).Error("failed to write recovery audit")
+	}
+
+	emitSecurityEvent(ctx, SecurityEvent{
+		Type:      SecurityEventRecoveryCodeUsed,
+		AccountID: accountID,
+		ClientIP:  clientIP,
+		Detail:    map[string]string{"remaining": strconv.FormatInt(remaining, 10)},
+		Time:      entry.Time,
+	})
+	return true, nil
+}
+
+// RecoveryAudit 返回账号最近的恢复码使用记录
+func RecoveryAudit(ctx context.Context, accountID string) ([]RecoveryAuditEntry, error) {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err := handler.LRange(ctx, RecoveryAuditKeyPrefix+accountID, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]RecoveryAuditEntry, 0, len(items))
+	for _, item := range items {
+		var e RecoveryAuditEntry
+		if err := json.Unmarshal([]byte(item), &e); err == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// newRecoveryCode 生成形如 abcde-fghij 的恢复码
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+	return s[:5] + "-" + s[5:], nil
+}
+
+// hashRecoveryCode 以账号作为盐计算摘要，忽略大小写、空格与连字符
+func hashRecoveryCode(accountID string, code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(accountID + ":" + normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,37 @@
+package middle
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRecoveryCodesDoNotCollideWithAudit(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+
+	codes, err := GenerateRecoveryCodes(ctx, "bob", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := consumeRecoveryCode(ctx, "bob", codes[0], "1.2.3.4")
+	if err != nil || !ok {
+		t.Fatalf("consume = %v, %v", ok, err)
+	}
+
+	// 账号 "audit:bob" 的恢复码不能覆盖账号 bob 的使用记录
+	if _, err := GenerateRecoveryCodes(ctx, "audit:bob", 2); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := RecoveryAudit(ctx, "bob")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("audit = %v, %v, want 1 entry", entries, err)
+	}
+	if n, err := RemainingRecoveryCodes(ctx, "audit:bob"); err != nil || n != 2 {
+		t.Fatalf("remaining = %d, %v, want 2", n, err)
+	}
+
+	// 恢复码只能使用一次
+	if ok, err := consumeRecoveryCode(ctx, "bob", codes[0], "1.2.3.4"); err != nil || ok {
+		t.Fatalf("reuse = %v, %v, want false", ok, err)
+	}
+}
@@ -0,0 +1,26 @@
+package middle
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// useTestRedis 为测试注入内存 redis，测试结束后恢复
+func useTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	SetMiddleRedis(client)
+	t.Cleanup(func() {
+		SetMiddleRedis(nil)
+		_ = client.Close()
+	})
+	return mr
+}
@@ -0,0 +1,329 @@
+package middle
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/open4go/log"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// RefreshFamilyKeyPrefix 刷新令牌族，一次登陆产生一个族，每次刷新轮换族内的令牌
+	RefreshFamilyKeyPrefix = "refresh:family:"
+	// RefreshCookieName 后台刷新令牌 cookie 名称
+	RefreshCookieName = "jwt_refresh"
+	// DefaultRefreshTokenTTL 刷新令牌族默认有效期
+	DefaultRefreshTokenTTL = 14 * 24 * time.Hour
+)
+
+// DefaultRefreshCookiePath 刷新令牌 cookie 的默认 Path
+// 浏览器只在刷新与退出登陆(SignOutPath)时携带，其它接口拿不到刷新令牌
+var DefaultRefreshCookiePath = "/v1/system/auth"
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token has already been used")
+)
+
+// TokenPair 客户端登陆或刷新后得到的令牌
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// rotateRefreshScript 原子地校验并轮换令牌
+// 返回 {status, account, login, created, access_jti, access_exp}
+// status: 1 成功, 0 无效, -1 旧令牌被重复使用(整个族已删除)
+var rotateRefreshScript = redis.NewScript(`
+local fields = redis.call('HMGET', KEYS[1], 'current', 'account', 'login', 'created', 'access_jti', 'access_exp')
+if not fields[1] then
+	return {0}
+end
+if fields[1] == ARGV[1] then
+	redis.call('HSET', KEYS[1], 'current', ARGV[2], 'used:' .. ARGV[1], '1')
+	return {1, fields[2], fields[3], fields[4]}
+end
+if redis.call('HEXISTS', KEYS[1], 'used:' .. ARGV[1]) == 1 then
+	redis.call('DEL', KEYS[1])
+	return {-1, fields[2], fields[3], fields[4], fields[5] or '', fields[6] or ''}
+end
+return {0}
+`)
+
+func (i *Issuer) refreshTTL() time.Duration {
+	if i.RefreshTTL > 0 {
+		return i.RefreshTTL
+	}
+	return DefaultRefreshTokenTTL
+}
+
+// IssueTokenPair 登陆成功后签发 bearer token 与刷新令牌
+func (i *Issuer) IssueTokenPair(ctx context.Context, l LoginInfo) (TokenPair, error) {
+	refreshToken, familyID, err := i.newRefreshFamily(ctx, l)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return i.bearerPair(ctx, l, familyID, refreshToken)
+}
+
+// SetCookieSession 登陆成功后写入后台 cookie 与刷新令牌 cookie
+func (i *Issuer) SetCookieSession(c *gin.Context, l LoginInfo) error {
+	refreshToken, familyID, err := i.newRefreshFamily(c.Request.Context(), l)
+	if err != nil {
+		return err
+	}
+	return i.setCookiePair(c, l, familyID, refreshToken)
+}
+
+// RefreshHandler 使用刷新令牌换取新的访问令牌
+// 刷新令牌可以放在 jwt_refresh cookie 中(后台)或 json body 的 refresh_token 字段中(客户端)
+// 每个刷新令牌只能使用一次，旧令牌被再次使用时吊销整个令牌族
+func (i *Issuer) RefreshHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		refreshToken, fromCookie := readRefreshToken(c)
+		if refreshToken == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "refresh token is required"})
+			return
+		}
+
+		l, familyID, next, err := i.rotateRefreshToken(ctx, c.ClientIP(), refreshToken)
+		if err != nil {
+			log.Log(ctx).WithError(err).Error("failed to rotate refresh token")
+			if !isRefreshRejected(err) {
+				// 存储不可用时保留 cookie，客户端可以稍后重试
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "refresh is temporarily unavailable", "code": AuthCodeRevocationUnavailable})
+				return
+			}
+			if fromCookie {
+				i.ClearCookie(c)
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		if fromCookie {
+			if err := i.setCookiePair(c, l, familyID, next); err != nil {
+				log.Log(ctx).WithError(err).Error("failed to issue cookie")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue token"})
+				return
+			}
+			c.Status(http.StatusNoContent)
+			return
+		}
+
+		pair, err := i.bearerPair(ctx, l, familyID, next)
+		if err != nil {
+			log.Log(ctx).WithError(err).Error("failed to issue access token")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue token"})
+			return
+		}
+		c.JSON(http.StatusOK, pair)
+	}
+}
+
+// isRefreshRejected 刷新令牌本身无效，而不是存储出错
+func isRefreshRejected(err error) bool {
+	return errors.Is(err, ErrRefreshTokenInvalid) ||
+		errors.Is(err, ErrRefreshTokenReused) ||
+		errors.Is(err, ErrTokenRevoked)
+}
+
+// RevokeRefreshFamily 吊销刷新令牌所属的令牌族，例如退出登陆时
+func RevokeRefreshFamily(ctx context.Context, refreshToken string) error {
+	familyID, _, ok := splitRefreshToken(refreshToken)
+	if !ok {
+		return ErrRefreshTokenInvalid
+	}
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return err
+	}
+	return handler.Del(ctx, RefreshFamilyKeyPrefix+familyID).Err()
+}
+
+func readRefreshToken(c *gin.Context) (string, bool) {
+	if cookie, err := c.Cookie(RefreshCookieName); err == nil && cookie != "" {
+		return cookie, true
+	}
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return "", false
+	}
+	return req.RefreshToken, false
+}
+
+func (i *Issuer) newRefreshFamily(ctx context.Context, l LoginInfo) (string, string, error) {
+	familyID := uuid.New().String()
+	secret, err := newRefreshSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	key := RefreshFamilyKeyPrefix + familyID
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	pipe := handler.TxPipeline()
+	pipe.HSet(ctx, key,
+		"current", hashRefreshSecret(secret),
+		"account", l.AccountID,
+		"login", DumpLoginInfo(l),
+		"created", strconv.FormatInt(time.Now().Unix(), 10),
+	)
+	pipe.Expire(ctx, key, i.refreshTTL())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", "", err
+	}
+	return familyID + "." + secret, familyID, nil
+}
+
+// rotateRefreshToken 校验并轮换令牌，返回登陆信息、令牌族与新的刷新令牌
+func (i *Issuer) rotateRefreshToken(ctx context.Context, clientIP string, refreshToken string) (LoginInfo, string, string, error) {
+	familyID, secret, ok := splitRefreshToken(refreshToken)
+	if !ok {
+		return LoginInfo{}, "", "", ErrRefreshTokenInvalid
+	}
+	next, err := newRefreshSecret()
+	if err != nil {
+		return LoginInfo{}, "", "", err
+	}
+
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return LoginInfo{}, "", "", err
+	}
+	rs, err := rotateRefreshScript.Run(ctx, handler,
+		[]string{RefreshFamilyKeyPrefix + familyID},
+		hashRefreshSecret(secret), hashRefreshSecret(next)).Slice()
+	if err != nil {
+		return LoginInfo{}, "", "", err
+	}
+
+	status, _ := rs[0].(int64)
+	switch status {
+	case 1:
+	case -1:
+		accountID := scriptString(rs, 1)
+		// 被盗用的令牌族中最后签发的访问令牌同样吊销
+		if jti := scriptString(rs, 4); jti != "" {
+			exp, _ := strconv.ParseInt(scriptString(rs, 5), 10, 64)
+			if err := RevokeToken(ctx, jti, unixTime(exp)); err != nil {
+				log.Log(ctx).WithError(err).Error("failed to revoke access token of reused family")
+			}
+		}
+		emitSecurityEvent(ctx, SecurityEvent{
+			Type:      SecurityEventRefreshReuse,
+			AccountID: accountID,
+			ClientIP:  clientIP,
+			Detail:    map[string]string{"family": familyID},
+		})
+		return LoginInfo{}, "", "", ErrRefreshTokenReused
+	default:
+		return LoginInfo{}, "", "", ErrRefreshTokenInvalid
+	}
+
+	var l LoginInfo
+	if err := l.Load(scriptString(rs, 2)); err != nil {
+		return LoginInfo{}, "", "", fmt.Errorf("invalid login info in refresh family: %w", err)
+	}
+
+	// 账号被整体吊销后，之前登陆产生的令牌族也不能再刷新
+	created, _ := strconv.ParseInt(scriptString(rs, 3), 10, 64)
+	revoked, err := IsTokenRevoked(ctx, "", l.AccountID, unixTime(created))
+	if err != nil {
+		return LoginInfo{}, "", "", err
+	}
+	if revoked {
+		_ = handler.Del(ctx, RefreshFamilyKeyPrefix+familyID).Err()
+		return LoginInfo{}, "", "", ErrTokenRevoked
+	}
+	return l, familyID, familyID + "." + next, nil
+}
+
+func (i *Issuer) bearerPair(ctx context.Context, l LoginInfo, familyID string, refreshToken string) (TokenPair, error) {
+	token, jti, expiresAt, err := i.signAccessToken(l)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if err := recordFamilyAccess(ctx, familyID, jti, expiresAt); err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(expiresAt.Sub(i.now()).Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (i *Issuer) setCookiePair(c *gin.Context, l LoginInfo, familyID string, refreshToken string) error {
+	token, jti, expiresAt, err := i.signCookieToken(l)
+	if err != nil {
+		return err
+	}
+	if err := recordFamilyAccess(c.Request.Context(), familyID, jti, expiresAt); err != nil {
+		return err
+	}
+	http.SetCookie(c.Writer, i.cookie(CookieName, token, expiresAt))
+	http.SetCookie(c.Writer, i.cookie(RefreshCookieName, refreshToken, i.now().Add(i.refreshTTL())))
+	return nil
+}
+
+// recordFamilyAccess 记录令牌族最后签发的访问令牌，检测到重复使用时一并吊销
+func recordFamilyAccess(ctx context.Context, familyID string, jti string, expiresAt time.Time) error {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return err
+	}
+	return handler.HSet(ctx, RefreshFamilyKeyPrefix+familyID,
+		"access_jti", jti,
+		"access_exp", strconv.FormatInt(expiresAt.Unix(), 10),
+	).Err()
+}
+
+func newRefreshSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashRefreshSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func splitRefreshToken(token string) (string, string, bool) {
+	familyID, secret, ok := strings.Cut(token, ".")
+	if !ok || familyID == "" || secret == "" {
+		return "", "", false
+	}
+	return familyID, secret, true
+}
+
+func scriptString(rs []interface{}, i int) string {
+	if i >= len(rs) {
+		return ""
+	}
+	s, _ := rs[i].(string)
+	return s
+}
@@ -0,0 +1,82 @@
+package middle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func cookieSession(t *testing.T, issuer *Issuer) map[string]*http.Cookie {
+	t.Helper()
+	r := gin.New()
+	r.POST("/login", func(c *gin.Context) {
+		if err := issuer.SetCookieSession(c, LoginInfo{AccountID: "acct"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/login", nil))
+	cookies := map[string]*http.Cookie{}
+	for _, c := range w.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	return cookies
+}
+
+func TestSignOutRevokesRefreshFamily(t *testing.T) {
+	mr := useTestRedis(t)
+	keyring := StaticKeyring([]byte("cookie-secret"))
+	issuer := &Issuer{Name: "test", Keyring: keyring}
+
+	cookies := cookieSession(t, issuer)
+	refresh := cookies[RefreshCookieName]
+	if refresh == nil || cookies[CookieName] == nil {
+		t.Fatalf("login did not set both cookies: %v", cookies)
+	}
+	if refresh.Path != DefaultRefreshCookiePath {
+		t.Fatalf("refresh cookie path = %q, want %q", refresh.Path, DefaultRefreshCookiePath)
+	}
+	if cookies[CookieName].Path != "/" {
+		t.Fatalf("access cookie path = %q, want /", cookies[CookieName].Path)
+	}
+	familyID, _, _ := splitRefreshToken(refresh.Value)
+	if !mr.Exists(RefreshFamilyKeyPrefix + familyID) {
+		t.Fatal("refresh family not stored")
+	}
+
+	r := gin.New()
+	r.POST("/"+SignOutPath, JWTKeyringMiddleware(keyring), func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.POST(DefaultRefreshCookiePath+"/refresh", issuer.RefreshHandler())
+
+	req := httptest.NewRequest(http.MethodPost, "/"+SignOutPath, nil)
+	req.AddCookie(cookies[CookieName])
+	req.AddCookie(refresh)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("sign out status = %d", w.Code)
+	}
+	if mr.Exists(RefreshFamilyKeyPrefix + familyID) {
+		t.Fatal("refresh family still exists after sign out")
+	}
+	cleared := false
+	for _, c := range w.Result().Cookies() {
+		if c.Name == RefreshCookieName && c.MaxAge < 0 && c.Path == DefaultRefreshCookiePath {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Fatalf("refresh cookie not cleared: %v", w.Header().Values("Set-Cookie"))
+	}
+
+	req = httptest.NewRequest(http.MethodPost, DefaultRefreshCookiePath+"/refresh", strings.NewReader(""))
+	req.AddCookie(refresh)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh after sign out status = %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,143 @@
+package middle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+var testBearerSecret = []byte("bearer-secret")
+
+func signBearer(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testBearerSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func bearerRequest(t *testing.T, h gin.HandlerFunc, token string, header http.Header) (int, string) {
+	t.Helper()
+	r := gin.New()
+	r.GET("/res", h, func(c *gin.Context) { c.Status(http.StatusOK) })
+	req := httptest.NewRequest(http.MethodGet, "/res", nil)
+	for k, v := range header {
+		req.Header.Set(k, v[0])
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var body struct {
+		Code string `json:"code"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body.Code
+}
+
+func TestBearerRevocation(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	h := JWTAuthMiddleware(testBearerSecret)
+	now := time.Now()
+	token := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": "j1", "iss": "test", "aud": "app",
+		"iat": now.Unix(), "exp": now.Add(time.Hour).Unix()})
+
+	if code, _ := bearerRequest(t, h, token, nil); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	if err := RevokeToken(ctx, "j1", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if code, reason := bearerRequest(t, h, token, nil); code != http.StatusUnauthorized || reason != AuthCodeTokenRevoked {
+		t.Fatalf("got %d %q, want 401 %q", code, reason, AuthCodeTokenRevoked)
+	}
+}
+
+func TestRevocationUnavailable(t *testing.T) {
+	mr := useTestRedis(t)
+	mr.Close()
+
+	_, err := IsTokenRevoked(context.Background(), "j1", "acct", time.Now())
+	if !errors.Is(err, ErrRevocationUnavailable) {
+		t.Fatalf("err = %v, want ErrRevocationUnavailable", err)
+	}
+
+	now := time.Now()
+	token := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": "j1", "iss": "test", "aud": "app",
+		"iat": now.Unix(), "exp": now.Add(time.Hour).Unix()})
+	code, reason := bearerRequest(t, JWTAuthMiddleware(testBearerSecret), token, nil)
+	if code != http.StatusServiceUnavailable || reason != AuthCodeRevocationUnavailable {
+		t.Fatalf("got %d %q, want 503 %q", code, reason, AuthCodeRevocationUnavailable)
+	}
+}
+
+func TestMiddleRedisNotConfigured(t *testing.T) {
+	SetMiddleRedis(nil)
+	if _, err := middleRedis(context.Background()); !errors.Is(err, ErrRedisUnavailable) {
+		t.Fatalf("err = %v, want ErrRedisUnavailable", err)
+	}
+}
+
+func TestAccountRevocationWithoutIssuedAt(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	h := JWTAuthMiddleware(testBearerSecret)
+	// 第三方签发的 token 没有 iat
+	token := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": "j1", "iss": "test", "aud": "app",
+		"exp": time.Now().Add(time.Hour).Unix()})
+
+	if code, _ := bearerRequest(t, h, token, nil); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	if err := RevokeAccountTokens(ctx, "acct"); err != nil {
+		t.Fatal(err)
+	}
+	if code, reason := bearerRequest(t, h, token, nil); code != http.StatusUnauthorized || reason != AuthCodeTokenRevoked {
+		t.Fatalf("got %d %q, want 401 %q", code, reason, AuthCodeTokenRevoked)
+	}
+	if revoked, err := IsTokenRevoked(ctx, "", "other", time.Time{}); err != nil || revoked {
+		t.Fatalf("other account = %v, %v, want false", revoked, err)
+	}
+}
+
+func wxRequest(t *testing.T, token string) (int, string) {
+	t.Helper()
+	r := gin.New()
+	r.GET("/res", VerifyTokenMiddleware(nil), func(c *gin.Context) { c.Status(http.StatusOK) })
+	req := httptest.NewRequest(http.MethodGet, "/res", nil)
+	req.Header.Set("token", token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var body struct {
+		Code string `json:"code"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body.Code
+}
+
+func TestWxAuthenticator(t *testing.T) {
+	mr := useTestRedis(t)
+	for _, field := range WxLoginFields {
+		mr.HSet(WxLoginSessionTokenKeyPrefix+"t1", field, "v-"+field)
+	}
+
+	if code, _ := wxRequest(t, "t1"); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	if code, _ := wxRequest(t, "t2"); code != http.StatusForbidden {
+		t.Fatalf("unknown token status = %d, want 403", code)
+	}
+
+	mr.Close()
+	if code, reason := wxRequest(t, "t1"); code != http.StatusServiceUnavailable || reason != AuthCodeSessionUnavailable {
+		t.Fatalf("got %d %q, want 503 %q", code, reason, AuthCodeSessionUnavailable)
+	}
+}
@@ -0,0 +1,93 @@
+package middle
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/open4go/log"
+)
+
+// ScopeMode RequireScopes 的匹配方式
+type ScopeMode int
+
+const (
+	// ScopeAll 需要具备全部 scope
+	ScopeAll ScopeMode = iota
+	// ScopeAny 具备任意一个 scope 即可
+	ScopeAny
+)
+
+type scopesKey struct{}
+
+// Scopes 返回 bearer token 授予的 scope
+func Scopes(ctx context.Context) []string {
+	scopes, _ := ctx.Value(scopesKey{}).([]string)
+	return scopes
+}
+
+func withScopes(ctx context.Context, scopes []string) context.Context {
+	return context.WithValue(ctx, scopesKey{}, scopes)
+}
+
+// RequireScopes 校验 token 的 scope，需挂载在 JWTAuthMiddleware 之后
+// 不满足时按 RFC 6750 返回 403 以及 WWW-Authenticate: Bearer error="insufficient_scope"
+func RequireScopes(mode ScopeMode, scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !scopesSatisfied(Scopes(c.Request.Context()), mode, scopes) {
+			log.Log(c.Request.Context()).
+				WithField("required", scopes).
+				WithField("granted", Scopes(c.Request.Context())).
+				Warn("insufficient scope")
+			abortInsufficientScope(c, scopes)
+			return
+		}
+		c.Next()
+	}
+}
+
+func scopesSatisfied(granted []string, mode ScopeMode, required []string) bool {
+	if len(required) == 0 {
+		return true
+	}
+	for _, s := range required {
+		has := containsString(granted, s)
+		if mode == ScopeAny && has {
+			return true
+		}
+		if mode == ScopeAll && !has {
+			return false
+		}
+	}
+	return mode == ScopeAll
+}
+
+func abortInsufficientScope(c *gin.Context, required []string) {
+	c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`,
+		strings.Join(required, " ")))
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"error": "insufficient_scope",
+		"scope": strings.Join(required, " "),
+	})
+}
+
+// scopeClaim 读取 scope(空格分隔的字符串) 或 scp(字符串或字符串数组)
+func scopeClaim(claims jwt.MapClaims) []string {
+	var scopes []string
+	for _, name := range []string{"scope", "scp"} {
+		switch v := claims[name].(type) {
+		case string:
+			scopes = append(scopes, strings.Fields(v)...)
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok && s != "" {
+					scopes = append(scopes, s)
+				}
+			}
+		}
+	}
+	return scopes
+}
@@ -0,0 +1,94 @@
+package middle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+func TestScopesSatisfied(t *testing.T) {
+	granted := []string{"orders:read", "profile"}
+	cases := []struct {
+		name     string
+		mode     ScopeMode
+		required []string
+		want     bool
+	}{
+		{"all, nothing required", ScopeAll, nil, true},
+		{"any, nothing required", ScopeAny, nil, true},
+		{"all, every scope granted", ScopeAll, []string{"orders:read", "profile"}, true},
+		{"all, one scope missing", ScopeAll, []string{"orders:read", "orders:write"}, false},
+		{"any, one scope granted", ScopeAny, []string{"orders:write", "profile"}, true},
+		{"any, none granted", ScopeAny, []string{"orders:write", "admin"}, false},
+	}
+	for _, tc := range cases {
+		if got := scopesSatisfied(granted, tc.mode, tc.required); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestScopeClaim(t *testing.T) {
+	cases := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   []string
+	}{
+		{"scope string", jwt.MapClaims{"scope": "orders:read  profile"}, []string{"orders:read", "profile"}},
+		{"scp array", jwt.MapClaims{"scp": []interface{}{"orders:read", "", 1, "profile"}}, []string{"orders:read", "profile"}},
+		{"scp string", jwt.MapClaims{"scp": "orders:read profile"}, []string{"orders:read", "profile"}},
+		{"both", jwt.MapClaims{"scope": "a", "scp": []interface{}{"b"}}, []string{"a", "b"}},
+		{"none", jwt.MapClaims{}, nil},
+	}
+	for _, tc := range cases {
+		if got := scopeClaim(tc.claims); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRequireScopesResponse(t *testing.T) {
+	useTestRedis(t)
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	auth := JWTAuthMiddleware(testBearerSecret)
+	r.GET("/all", auth, RequireScopes(ScopeAll, "orders:read", "orders:write"), ok)
+	r.GET("/any", auth, RequireScopes(ScopeAny, "orders:read", "orders:write"), ok)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	arrayToken := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": "j1", "iss": "test", "aud": "app", "exp": exp,
+		"scp": []string{"orders:read"}})
+	stringToken := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": "j2", "iss": "test", "aud": "app", "exp": exp,
+		"scope": "orders:read orders:write"})
+
+	cases := []struct {
+		name   string
+		path   string
+		token  string
+		want   int
+		header string
+	}{
+		{"any with scp array", "/any", arrayToken, http.StatusOK, ""},
+		{"all with scp array", "/all", arrayToken, http.StatusForbidden,
+			`Bearer error="insufficient_scope", scope="orders:read orders:write"`},
+		{"all with scope string", "/all", stringToken, http.StatusOK, ""},
+		{"any with scope string", "/any", stringToken, http.StatusOK, ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, w.Code, tc.want)
+		}
+		if got := w.Header().Get("WWW-Authenticate"); got != tc.header {
+			t.Errorf("%s: WWW-Authenticate = %q, want %q", tc.name, got, tc.header)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package middle
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/open4go/log"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+	"github.com/pquerna/otp/totp"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// HOTPCounterKeyPrefix HOTP 下一个可接受的计数器
+	HOTPCounterKeyPrefix = "2fa:hotp:"
+	// OneTimeCodeKeyPrefix 短信/邮件验证码摘要，key 为 渠道:账号，ttl 即有效期
+	OneTimeCodeKeyPrefix = "2fa:code:"
+	// OneTimeCodeSentKeyPrefix 最近一次发送的标记，用于限制重发频率
+	OneTimeCodeSentKeyPrefix = "2fa:code:sent:"
+)
+
+// 短信/邮件验证码默认配置
+var (
+	// DefaultOneTimeCodeTTL 验证码有效期
+	DefaultOneTimeCodeTTL = 5 * time.Minute
+	// DefaultOneTimeCodeResend 两次发送的最小间隔
+	DefaultOneTimeCodeResend = time.Minute
+)
+
+// ErrCodeResendTooSoon 距上次发送验证码的时间太短
+var ErrCodeResendTooSoon = errors.New("one-time code was sent recently")
+
+// SecondFactor 二次验证方式
+type SecondFactor interface {
+	// Name 验证方式名称，例如 totp/hotp/sms/email
+	Name() string
+	// Challenge 下发验证码，TOTP/HOTP 由用户设备生成，无需下发
+	Challenge(ctx context.Context, accountID string) error
+	// Verify 校验验证码，同一验证码只能使用一次
+	Verify(ctx context.Context, accountID string, code string, clientIP string) (bool, error)
+}
+
+// DefaultSecondFactor 未指定时使用的验证方式，与 Google Authenticator 兼容
+var DefaultSecondFactor SecondFactor = TOTPFactor{
+	Period:    30,
+	Skew:      1,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// TOTPFactor 基于时间的验证码，密钥读取自 GetSecondFactorSecret
+type TOTPFactor struct {
+	// Period 时间片长度(秒)，0 时为 30
+	Period uint
+	// Skew 前后允许的时间片数量
+	Skew uint
+	// Digits 验证码位数，0 时为 6
+	Digits otp.Digits
+	// Algorithm 默认 SHA1
+	Algorithm otp.Algorithm
+}
+
+// Name 实现 SecondFactor
+func (f TOTPFactor) Name() string { return "totp" }
+
+// Challenge 实现 SecondFactor，TOTP 无需下发
+func (f TOTPFactor) Challenge(context.Context, string) error { return nil }
+
+// Verify 校验 TOTP 验证码，每个 (账号, 时间片) 只能使用一次
+func (f TOTPFactor) Verify(ctx context.Context, accountID string, code string, clientIP string) (bool, error) {
+	secret, err := GetSecondFactorSecret(ctx, accountID)
+	if err != nil {
+		return false, err
+	}
+	opts := f.opts()
+	step, ok, err := matchTOTPStep(secret, code, time.Now(), opts)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	// 保留到该时间片不再被接受为止
+	ttl := time.Duration(opts.Period*(2*opts.Skew+1)) * time.Second
+	key := TOTPUsedKeyPrefix + accountID + ":" + strconv.FormatInt(step, 10)
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return false, err
+	}
+	fresh, err := handler.SetNX(ctx, key, 1, ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	if !fresh {
+		emitSecurityEvent(ctx, SecurityEvent{
+			Type:      SecurityEventTOTPReplay,
+			AccountID: accountID,
+			ClientIP:  clientIP,
+			Detail:    map[string]string{"step": strconv.FormatInt(step, 10)},
+		})
+		return false, nil
+	}
+	return true, nil
+}
+
+func (f TOTPFactor) opts() totp.ValidateOpts {
+	opts := totp.ValidateOpts{Period: f.Period, Skew: f.Skew, Digits: f.Digits, Algorithm: f.Algorithm}
+	if opts.Period == 0 {
+		opts.Period = 30
+	}
+	if opts.Digits == 0 {
+		opts.Digits = otp.DigitsSix
+	}
+	return opts
+}
+
+// matchTOTPStep 返回与验证码匹配的时间片
+func matchTOTPStep(secret string, code string, t time.Time, opts totp.ValidateOpts) (int64, bool, error) {
+	period := int64(opts.Period)
+	current := t.Unix() / period
+	for _, offset := range skewOffsets(int64(opts.Skew)) {
+		step := current + offset
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*period, 0), opts)
+		if err != nil {
+			return 0, false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// skewOffsets 0, -1, 1, -2, 2 ...
+func skewOffsets(skew int64) []int64 {
+	offsets := []int64{0}
+	for i := int64(1); i <= skew; i++ {
+		offsets = append(offsets, -i, i)
+	}
+	return offsets
+}
+
+// HOTPFactor 基于计数器的验证码，密钥读取自 GetSecondFactorSecret
+// 计数器保存在 redis，验证成功后前移，之前的验证码全部失效
+type HOTPFactor struct {
+	// LookAhead 允许设备计数器领先的数量，用于容忍未提交的按键，建议 10 左右
+	LookAhead uint
+	// Digits 验证码位数，0 时为 6
+	Digits otp.Digits
+	// Algorithm 默认 SHA1
+	Algorithm otp.Algorithm
+}
+
+// advanceHOTPScript 仅当计数器未被其它请求修改时前移
+var advanceHOTPScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1]) or '0'
+if current ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2])
+return 1
+`)
+
+// Name 实现 SecondFactor
+func (f HOTPFactor) Name() string { return "hotp" }
+
+// Challenge 实现 SecondFactor，HOTP 无需下发
+func (f HOTPFactor) Challenge(context.Context, string) error { return nil }
+
+// Verify 在 [counter, counter+LookAhead] 内查找匹配的计数器并前移
+func (f HOTPFactor) Verify(ctx context.Context, accountID string, code string, clientIP string) (bool, error) {
+	secret, err := GetSecondFactorSecret(ctx, accountID)
+	if err != nil {
+		return false, err
+	}
+	counter, err := HOTPCounter(ctx, accountID)
+	if err != nil {
+		return false, err
+	}
+
+	opts := hotp.ValidateOpts{Digits: f.Digits, Algorithm: f.Algorithm}
+	if opts.Digits == 0 {
+		opts.Digits = otp.DigitsSix
+	}
+	for i := uint64(0); i <= uint64(f.LookAhead); i++ {
+		expected, err := hotp.GenerateCodeCustom(secret, counter+i, opts)
+		if err != nil {
+			return false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) != 1 {
+			continue
+		}
+		key := HOTPCounterKeyPrefix + accountID
+		next := strconv.FormatUint(counter+i+1, 10)
+		handler, err := middleRedis(ctx)
+		if err != nil {
+			return false, err
+		}
+		n, err := advanceHOTPScript.Run(ctx, handler, []string{key},
+			strconv.FormatUint(counter, 10), next).Int()
+		if err != nil {
+			return false, err
+		}
+		if n == 0 {
+			// 并发请求已使用该验证码
+			emitSecurityEvent(ctx, SecurityEvent{
+				Type:      SecurityEventTOTPReplay,
+				AccountID: accountID,
+				ClientIP:  clientIP,
+				Detail:    map[string]string{"factor": f.Name(), "counter": strconv.FormatUint(counter+i, 10)},
+			})
+			return false, nil
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// HOTPCounter 返回账号下一个可接受的计数器，未使用过时为 0
+func HOTPCounter(ctx context.Context, accountID string) (uint64, error) {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return 0, err
+	}
+	v, err := handler.Get(ctx, HOTPCounterKeyPrefix+accountID).Uint64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return v, err
+}
+
+// ResetHOTPCounter 重新绑定设备时清除计数器
+func ResetHOTPCounter(ctx context.Context, accountID string) error {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return err
+	}
+	return handler.Del(ctx, HOTPCounterKeyPrefix+accountID).Err()
+}
+
+// CodeSender 下发验证码，由业务实现，根据账号查找手机号或邮箱
+type CodeSender interface {
+	Send(ctx context.Context, accountID string, code string) error
+}
+
+// CodeFactor 通过短信或邮件下发的一次性验证码
+// redis 中只保存验证码摘要，验证成功或过期后失效
+type CodeFactor struct {
+	// Channel 渠道名称，例如 sms/email，不同渠道的验证码互不通用
+	Channel string
+	Sender  CodeSender
+	// Digits 验证码位数，0 时为 6
+	Digits int
+	// TTL 有效期，0 时使用 DefaultOneTimeCodeTTL
+	TTL time.Duration
+	// Resend 两次发送的最小间隔，0 时使用 DefaultOneTimeCodeResend，小于 0 时不限制
+	Resend time.Duration
+}
+
+// SMSFactor 短信验证码
+func SMSFactor(sender CodeSender) CodeFactor {
+	return CodeFactor{Channel: "sms", Sender: sender}
+}
+
+// EmailFactor 邮件验证码
+func EmailFactor(sender CodeSender) CodeFactor {
+	return CodeFactor{Channel: "email", Sender: sender}
+}
+
+// consumeCodeScript 摘要一致时删除并返回 1
+var consumeCodeScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('DEL', KEYS[1])
+	return 1
+end
+return 0
+`)
+
+// Name 实现 SecondFactor
+func (f CodeFactor) Name() string { return f.Channel }
+
+// Challenge 生成新的验证码并下发，之前的验证码随之失效
+func (f CodeFactor) Challenge(ctx context.Context, accountID string) error {
+	if f.Sender == nil {
+		return errors.New("code sender is not configured")
+	}
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return err
+	}
+	if resend := f.resend(); resend > 0 {
+		fresh, err := handler.SetNX(ctx, OneTimeCodeSentKeyPrefix+f.Channel+":"+accountID, 1, resend).Result()
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return ErrCodeResendTooSoon
+		}
+	}
+
+	code, err := newOneTimeCode(f.digits())
+	if err != nil {
+		return err
+	}
+	if err := handler.Set(ctx, f.key(accountID), hashOneTimeCode(accountID, code), f.ttl()).Err(); err != nil {
+		return err
+	}
+	if err := f.Sender.Send(ctx, accountID, code); err != nil {
+		// 下发失败时作废验证码，允许立即重试
+		handler.Del(ctx, f.key(accountID), OneTimeCodeSentKeyPrefix+f.Channel+":"+accountID)
+		return err
+	}
+	return nil
+}
+
+// Verify 校验并作废验证码
+func (f CodeFactor) Verify(ctx context.Context, accountID string, code string, _ string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return false, err
+	}
+	n, err := consumeCodeScript.Run(ctx, handler, []string{f.key(accountID)},
+		hashOneTimeCode(accountID, code)).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (f CodeFactor) key(accountID string) string {
+	return OneTimeCodeKeyPrefix + f.Channel + ":" + accountID
+}
+
+func (f CodeFactor) digits() int {
+	if f.Digits <= 0 {
+		return 6
+	}
+	return f.Digits
+}
+
+func (f CodeFactor) ttl() time.Duration {
+	if f.TTL <= 0 {
+		return DefaultOneTimeCodeTTL
+	}
+	return f.TTL
+}
+
+func (f CodeFactor) resend() time.Duration {
+	if f.Resend == 0 {
+		return DefaultOneTimeCodeResend
+	}
+	return f.Resend
+}
+
+// newOneTimeCode 生成 n 位数字验证码
+func newOneTimeCode(n int) (string, error) {
+	b := make([]byte, n)
+	ten := big.NewInt(10)
+	for i := range b {
+		d, err := rand.Int(rand.Reader, ten)
+		if err != nil {
+			return "", err
+		}
+		b[i] = byte('0' + d.Int64())
+	}
+	return string(b), nil
+}
+
+func hashOneTimeCode(accountID string, code string) string {
+	sum := sha256.Sum256([]byte(accountID + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// SecondFactorChallengeHandler 下发验证码，需挂载在 JWTMiddleware 之后
+func SecondFactorChallengeHandler(factor SecondFactor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		l, ok := Identity(ctx)
+		if !ok || l.AccountID == "" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		err := factor.Challenge(ctx, l.AccountID)
+		if errors.Is(err, ErrCodeResendTooSoon) {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Log(ctx).WithField("factor", factor.Name()).WithError(err).Error("failed to send second factor challenge")
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,134 @@
+package middle
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+)
+
+// memorySender 保存在内存中的 CodeSender
+type memorySender struct {
+	mu    sync.Mutex
+	codes map[string]string
+}
+
+func newMemorySender() *memorySender {
+	return &memorySender{codes: map[string]string{}}
+}
+
+func (s *memorySender) Send(_ context.Context, accountID string, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[accountID] = code
+	return nil
+}
+
+// last 返回最近一次发给账号的验证码
+func (s *memorySender) last(t *testing.T, accountID string) string {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code, ok := s.codes[accountID]
+	if !ok {
+		t.Fatalf("no code sent to %s", accountID)
+	}
+	return code
+}
+
+func TestCodeFactorVerifyOnce(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	sender := newMemorySender()
+	f := SMSFactor(sender)
+
+	if err := f.Challenge(ctx, "acct"); err != nil {
+		t.Fatal(err)
+	}
+	code := sender.last(t, "acct")
+	if len(code) != 6 {
+		t.Fatalf("code = %q, want 6 digits", code)
+	}
+
+	if ok, err := f.Verify(ctx, "other", code, ""); err != nil || ok {
+		t.Fatalf("other account = %v, %v, want false", ok, err)
+	}
+	if ok, err := EmailFactor(sender).Verify(ctx, "acct", code, ""); err != nil || ok {
+		t.Fatalf("other channel = %v, %v, want false", ok, err)
+	}
+	if ok, err := f.Verify(ctx, "acct", code, ""); err != nil || !ok {
+		t.Fatalf("verify = %v, %v, want true", ok, err)
+	}
+	if ok, err := f.Verify(ctx, "acct", code, ""); err != nil || ok {
+		t.Fatalf("reuse = %v, %v, want false", ok, err)
+	}
+}
+
+func TestCodeFactorResendAndExpiry(t *testing.T) {
+	mr := useTestRedis(t)
+	ctx := context.Background()
+	sender := newMemorySender()
+	f := CodeFactor{Channel: "sms", Sender: sender, TTL: time.Minute, Resend: 30 * time.Second}
+
+	if err := f.Challenge(ctx, "acct"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Challenge(ctx, "acct"); err != ErrCodeResendTooSoon {
+		t.Fatalf("resend = %v, want %v", err, ErrCodeResendTooSoon)
+	}
+
+	mr.FastForward(30 * time.Second)
+	if err := f.Challenge(ctx, "acct"); err != nil {
+		t.Fatal(err)
+	}
+	code := sender.last(t, "acct")
+
+	mr.FastForward(time.Minute)
+	if ok, err := f.Verify(ctx, "acct", code, ""); err != nil || ok {
+		t.Fatalf("expired = %v, %v, want false", ok, err)
+	}
+}
+
+func TestHOTPFactorCounter(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	enrollTOTP(t, "acct")
+	f := HOTPFactor{LookAhead: 3}
+
+	code := func(counter uint64) string {
+		t.Helper()
+		c, err := hotp.GenerateCodeCustom(testTOTPSecret, counter, hotp.ValidateOpts{Digits: otp.DigitsSix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	verify := func(c string, want bool, next uint64) {
+		t.Helper()
+		ok, err := f.Verify(ctx, "acct", c, "")
+		if err != nil || ok != want {
+			t.Fatalf("verify = %v, %v, want %v", ok, err, want)
+		}
+		if n, err := HOTPCounter(ctx, "acct"); err != nil || n != next {
+			t.Fatalf("counter = %d, %v, want %d", n, err, next)
+		}
+	}
+
+	verify(code(0), true, 1)
+	// 已使用的验证码失效
+	verify(code(0), false, 1)
+	// 设备领先时在 LookAhead 内重新同步
+	verify(code(3), true, 4)
+	// 跳过的验证码同样失效
+	verify(code(2), false, 4)
+	// 超出 LookAhead 不接受
+	verify(code(8), false, 4)
+
+	if err := ResetHOTPCounter(ctx, "acct"); err != nil {
+		t.Fatal(err)
+	}
+	verify(code(0), true, 1)
+}
@@ -0,0 +1,44 @@
+package middle
+
+import (
+	"context"
+	"time"
+
+	"github.com/open4go/log"
+)
+
+// 安全事件类型
+const (
+	SecurityEventRefreshReuse = "refresh_token_reuse"
+)
+
+// SecurityEvent 需要告警或审计的安全事件
+type SecurityEvent struct {
+	Type      string            `json:"type"`
+	AccountID string            `json:"account_id"`
+	ClientIP  string            `json:"client_ip"`
+	Detail    map[string]string `json:"detail,omitempty"`
+	Time      time.Time         `json:"time"`
+}
+
+// OnSecurityEvent 安全事件回调，可在 main 中设置用于告警
+// 事件总会先写入 warn 级别日志
+var OnSecurityEvent func(ctx context.Context, event SecurityEvent)
+
+func emitSecurityEvent(ctx context.Context, event SecurityEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	entry := log.Log(ctx).
+		WithField("event", event.Type).
+		WithField("accountId", event.AccountID).
+		WithField("clientIP", event.ClientIP)
+	for k, v := range event.Detail {
+		entry = entry.WithField(k, v)
+	}
+	entry.Warn("security event")
+
+	if OnSecurityEvent != nil {
+		OnSecurityEvent(ctx, event)
+	}
+}
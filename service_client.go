@@ -0,0 +1,253 @@
+package middle
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/open4go/log"
+	"github.com/open4go/model"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// IdentityAssertionHeader 服务间调用时携带的身份断言
+	IdentityAssertionHeader = "X-Identity-Assertion"
+	// TenantIDHeader 服务间调用时携带的租户
+	TenantIDHeader = "X-Tenant-ID"
+	// identityAssertionType 断言的 typ 头部，用于区分 cookie token
+	identityAssertionType = "identity+jwt"
+)
+
+// DefaultIdentityAssertionTTL 身份断言的有效期，只用于单次调用
+var DefaultIdentityAssertionTTL = time.Minute
+
+// ErrIdentityAssertionMissing 请求中没有身份断言
+var ErrIdentityAssertionMissing = errors.New("identity assertion is missing")
+
+// ClientOptions 服务间调用的配置
+type ClientOptions struct {
+	// Keyring 签发身份断言的密钥，为 nil 时不携带断言
+	// 应与 cookie 使用不同的 keyring，避免断言被当作 cookie 使用
+	Keyring *Keyring
+	// Issuer 当前服务名称，写入 iss
+	Issuer string
+	// Audience 目标服务名称，写入 aud，为空时不限制
+	Audience string
+	// TTL 断言有效期，0 时使用 DefaultIdentityAssertionTTL
+	TTL time.Duration
+	// Timeout 为 0 时不设置超时
+	Timeout time.Duration
+	// Transport 为 nil 时使用 http.DefaultTransport
+	Transport http.RoundTripper
+	// Propagator 为 nil 时使用 W3C trace context
+	Propagator propagation.TextMapPropagator
+}
+
+// DefaultClientOptions NewClient 使用的配置，通常在启动时设置 Keyring 与 Issuer
+var DefaultClientOptions = ClientOptions{Timeout: 10 * time.Second}
+
+// NewClient 返回携带当前请求上下文的 http 客户端
+// 发出的请求会带上 traceparent、X-Request-ID、X-Tenant-ID 与签名的身份断言
+func NewClient(ctx context.Context) *http.Client {
+	return NewClientWithOptions(ctx, DefaultClientOptions)
+}
+
+// NewClientWithOptions 与 NewClient 相同，使用指定的配置
+func NewClientWithOptions(ctx context.Context, opts ClientOptions) *http.Client {
+	return &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: &PropagatingTransport{Source: ctx, Options: opts},
+	}
+}
+
+// PropagatingTransport 将请求上下文中的关联信息写入出站请求
+type PropagatingTransport struct {
+	// Source 读取关联信息的上下文，为 nil 时使用 req.Context()
+	Source  context.Context
+	Options ClientOptions
+}
+
+// RoundTrip 实现 http.RoundTripper
+func (t *PropagatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := t.Source
+	if ctx == nil {
+		ctx = req.Context()
+	}
+	// RoundTripper 不能修改传入的请求
+	out := req.Clone(req.Context())
+	if err := t.Options.inject(ctx, out.Header); err != nil {
+		return nil, err
+	}
+
+	base := t.Options.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(out)
+}
+
+func (o ClientOptions) inject(ctx context.Context, header http.Header) error {
+	propagator := o.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+	if header.Get(TraceparentHeader) == "" {
+		// 没有挂载 TracingMiddleware 时沿用关联 id 作为 trace id
+		if tp := fallbackTraceparent(ctx); tp != "" {
+			header.Set(TraceparentHeader, tp)
+		}
+	}
+
+	if id := RequestID(ctx); id != "" {
+		header.Set(RequestIDHeader, id)
+	}
+	if tenant := tenantFromContext(ctx); tenant != "" {
+		header.Set(TenantIDHeader, tenant)
+	}
+
+	l, ok := Identity(ctx)
+	if !ok || l.AccountID == "" || o.Keyring == nil {
+		return nil
+	}
+	assertion, err := o.signAssertion(l)
+	if err != nil {
+		return fmt.Errorf("failed to sign identity assertion: %w", err)
+	}
+	header.Set(IdentityAssertionHeader, assertion)
+	return nil
+}
+
+// fallbackTraceparent 使用入站 trace id 或关联 id 生成新的 span id
+func fallbackTraceparent(ctx context.Context) string {
+	traceID, flags := RequestID(ctx), "00"
+	if tc, ok := InboundTraceContext(ctx); ok {
+		traceID, flags = tc.TraceID, tc.Flags
+	}
+	if !isLowerHex(traceID, 32) {
+		return ""
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return "00-" + traceID + "-" + hex.EncodeToString(b) + "-" + flags
+}
+
+func (o ClientOptions) signAssertion(l LoginInfo) (string, error) {
+	key, err := o.Keyring.Active()
+	if err != nil {
+		return "", err
+	}
+	ttl := o.TTL
+	if ttl <= 0 {
+		ttl = DefaultIdentityAssertionTTL
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, NewLoginClaims(l, jwt.StandardClaims{
+		Id:        uuid.New().String(),
+		Subject:   l.AccountID,
+		Issuer:    o.Issuer,
+		Audience:  o.Audience,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}))
+	token.Header["typ"] = identityAssertionType
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.Secret)
+}
+
+// IdentityAssertionOptions 校验身份断言的配置
+type IdentityAssertionOptions struct {
+	// Issuers 允许的调用方，为空时不校验
+	Issuers []string
+	// Audience 当前服务名称，不为空时要求 aud 一致
+	Audience string
+}
+
+// IdentityAssertionMiddleware 校验 NewClient 签发的身份断言并恢复调用方的身份
+func IdentityAssertionMiddleware(keyring *Keyring, opts IdentityAssertionOptions) gin.HandlerFunc {
+	return authMiddleware(IdentityAssertionAuthenticator(keyring, opts))
+}
+
+// IdentityAssertionAuthenticator IdentityAssertionMiddleware 的认证步骤，可在 AuthRegistry 中使用
+func IdentityAssertionAuthenticator(keyring *Keyring, opts IdentityAssertionOptions) Authenticator {
+	return func(c *gin.Context) bool {
+		setAuthScheme(c, SchemeService)
+		stripUntrustedIdentityHeaders(c)
+		l, err := VerifyIdentityAssertion(keyring, opts, c.GetHeader(IdentityAssertionHeader))
+		if err != nil {
+			log.Log(c.Request.Context()).WithError(err).Error("Failed to verify identity assertion")
+			if errors.Is(err, ErrIdentityAssertionMissing) {
+				recordAuthFailure(c, AuthCodeMissingHeader)
+			} else {
+				recordAuthFailure(c, tokenFailureCode(err))
+			}
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return false
+		}
+
+		ctx := context.WithValue(c.Request.Context(), model.AccountKey, l.AccountID)
+		if l.MerchantID != "" {
+			ctx = context.WithValue(ctx, model.MerchantKey, l.MerchantID)
+		}
+		ctx = withIdentity(ctx, *l)
+		c.Request = c.Request.WithContext(ctx)
+		c.Set("accountId", l.AccountID)
+		return true
+	}
+}
+
+// rejectIdentityAssertion 登陆 token 的解析不接受身份断言
+// 断言与 cookie token 可能共用同一个 Keyring，不检查 typ 时断言可以被当作登陆 token 使用
+func rejectIdentityAssertion(keyFunc jwt.Keyfunc) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ == identityAssertionType {
+			return nil, errors.New("identity assertion cannot be used as a login token")
+		}
+		return keyFunc(token)
+	}
+}
+
+// VerifyIdentityAssertion 校验身份断言并返回其中的登陆信息
+func VerifyIdentityAssertion(keyring *Keyring, opts IdentityAssertionOptions, assertion string) (*LoginInfo, error) {
+	if assertion == "" {
+		return nil, ErrIdentityAssertionMissing
+	}
+	claims := &LoginClaims{}
+	token, err := jwt.ParseWithClaims(assertion, claims, keyring.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	if typ, _ := token.Header["typ"].(string); typ != identityAssertionType {
+		return nil, fmt.Errorf("unexpected assertion type %q", typ)
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, errors.New("identity assertion has no expiry")
+	}
+	if len(opts.Issuers) > 0 && !containsString(opts.Issuers, claims.Issuer) {
+		return nil, fmt.Errorf("issuer %q is not allowed", claims.Issuer)
+	}
+	if opts.Audience != "" && !claims.VerifyAudience(opts.Audience, true) {
+		return nil, fmt.Errorf("audience %q not found in assertion", opts.Audience)
+	}
+	l, err := claims.Info()
+	if err != nil {
+		return nil, err
+	}
+	if l.AccountID == "" || l.AccountID != claims.Subject {
+		return nil, errors.New("identity assertion subject mismatch")
+	}
+	return l, nil
+}
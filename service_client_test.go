@@ -0,0 +1,51 @@
+package middle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIdentityAssertionIsNotALoginToken(t *testing.T) {
+	useTestRedis(t)
+	keyring := StaticKeyring([]byte("shared-secret"))
+	assertion, err := ClientOptions{Keyring: keyring}.signAssertion(LoginInfo{AccountID: "acct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyIdentityAssertion(keyring, IdentityAssertionOptions{}, assertion); err != nil {
+		t.Fatalf("assertion should verify as an assertion: %v", err)
+	}
+
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/cookie", JWTKeyringMiddleware(keyring), ok)
+	r.GET("/bearer", JWTAuthWithOptions(keyring.Keyfunc, JWTAuthOptions{}), ok)
+
+	req := httptest.NewRequest(http.MethodGet, "/cookie", nil)
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: assertion})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("cookie status = %d, want 401", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/bearer", nil)
+	req.Header.Set("Authorization", "Bearer "+assertion)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("bearer status = %d, want 401", w.Code)
+	}
+
+	// 普通的 cookie token 不受影响
+	req = httptest.NewRequest(http.MethodGet, "/cookie", nil)
+	req.AddCookie(sessionCookie(t, keyring))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("session cookie status = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,83 @@
+package middle
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// StepUpKeyPrefix 提权授权，绑定到会话 jti 与资源类别
+	StepUpKeyPrefix = "2fa:stepup:"
+	// DefaultStepUpClass 未指定资源类别时使用
+	DefaultStepUpClass = "default"
+)
+
+// DefaultStepUpTTL StepUpOptions.TTL 为 0 时使用的免验证时长
+// 设置为 0 或负数时 SecondValidateStepUpMiddleware 同样每次请求都需要验证码
+var DefaultStepUpTTL = 5 * time.Minute
+
+// StepUpOptions 提权授权配置
+type StepUpOptions struct {
+	// Class 受保护资源的类别，例如 "phone-decrypt"，由调用方按路由指定，不同类别的授权互不通用
+	// 为空时使用 DefaultStepUpClass，所有未指定类别的路由共用授权
+	Class string
+	// TTL 授权有效期，0 时使用 DefaultStepUpTTL，小于 0 时不授权，每次请求都需要验证码
+	TTL time.Duration
+	// Factor 验证方式，nil 时使用 DefaultSecondFactor
+	Factor SecondFactor
+}
+
+func (o StepUpOptions) factor() SecondFactor {
+	if o.Factor == nil {
+		return DefaultSecondFactor
+	}
+	return o.Factor
+}
+
+func (o StepUpOptions) class() string {
+	if o.Class == "" {
+		return DefaultStepUpClass
+	}
+	return o.Class
+}
+
+func (o StepUpOptions) ttl() time.Duration {
+	if o.TTL == 0 {
+		return DefaultStepUpTTL
+	}
+	return o.TTL
+}
+
+func stepUpKey(session string, class string) string {
+	return StepUpKeyPrefix + session + ":" + class
+}
+
+// grantStepUp 记录提权授权，有效期从验证成功时开始计算，使用时不延长
+func grantStepUp(ctx context.Context, session string, class string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return err
+	}
+	return handler.Set(ctx, stepUpKey(session, class), time.Now().Unix(), ttl).Err()
+}
+
+func hasStepUpGrant(ctx context.Context, session string, class string) (bool, error) {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return false, err
+	}
+	n, err := handler.Exists(ctx, stepUpKey(session, class)).Result()
+	return n > 0, err
+}
+
+// RevokeStepUp 撤销会话在某类资源上的提权授权，session 为 cookie 的 jti
+func RevokeStepUp(ctx context.Context, session string, class string) error {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return err
+	}
+	return handler.Del(ctx, stepUpKey(session, class)).Err()
+}
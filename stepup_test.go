@@ -0,0 +1,150 @@
+package middle
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp/totp"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+func enrollTOTP(t *testing.T, accountID string) {
+	t.Helper()
+	if err := SetSecondFactorSecret(context.Background(), accountID, testTOTPSecret); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func currentTOTP(t *testing.T) string {
+	t.Helper()
+	code, err := totp.GenerateCode(testTOTPSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func sessionCookie(t *testing.T, keyring *Keyring) *http.Cookie {
+	t.Helper()
+	token, _, err := (&Issuer{Name: "test", Keyring: keyring}).IssueCookieToken(LoginInfo{AccountID: "acct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: CookieName, Value: token}
+}
+
+func stepUpRouter(routes map[string]gin.HandlerFunc) *gin.Engine {
+	r := gin.New()
+	for path, h := range routes {
+		r.GET(path, h, func(c *gin.Context) { c.Status(http.StatusOK) })
+	}
+	return r
+}
+
+func stepUpRequest(r *gin.Engine, path string, cookie *http.Cookie, code string) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.AddCookie(cookie)
+	if code != "" {
+		req.Header.Set("X-TOTP-Code", code)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestSecondValidateRequiresCodeEveryRequest(t *testing.T) {
+	useTestRedis(t)
+	enrollTOTP(t, "acct")
+	keyring := StaticKeyring([]byte("cookie-secret"))
+	cookie := sessionCookie(t, keyring)
+
+	// 即使存在同类别的授权，原有中间件也不使用
+	opt := SecondValidateStepUpMiddleware(keyring, StepUpOptions{})
+	r := stepUpRouter(map[string]gin.HandlerFunc{
+		"/legacy": SecondValidateKeyringMiddleware(keyring),
+		"/opt":    opt,
+	})
+	if code := stepUpRequest(r, "/opt", cookie, currentTOTP(t)); code != http.StatusOK {
+		t.Fatalf("step-up status = %d", code)
+	}
+	if code := stepUpRequest(r, "/legacy", cookie, ""); code != http.StatusBadRequest {
+		t.Fatalf("legacy without code status = %d, want 400", code)
+	}
+}
+
+func TestStepUpGrantIsPerClass(t *testing.T) {
+	useTestRedis(t)
+	enrollTOTP(t, "acct")
+	keyring := StaticKeyring([]byte("cookie-secret"))
+	cookie := sessionCookie(t, keyring)
+
+	r := stepUpRouter(map[string]gin.HandlerFunc{
+		"/phone":  SecondValidateStepUpMiddleware(keyring, StepUpOptions{Class: "phone-decrypt"}),
+		"/export": SecondValidateStepUpMiddleware(keyring, StepUpOptions{Class: "export", TTL: time.Minute}),
+	})
+	if code := stepUpRequest(r, "/phone", cookie, currentTOTP(t)); code != http.StatusOK {
+		t.Fatalf("first request status = %d", code)
+	}
+	if code := stepUpRequest(r, "/phone", cookie, ""); code != http.StatusOK {
+		t.Fatalf("granted request status = %d, want 200", code)
+	}
+	if code := stepUpRequest(r, "/export", cookie, ""); code != http.StatusBadRequest {
+		t.Fatalf("other class status = %d, want 400", code)
+	}
+}
+
+func TestStepUpLockoutRetryAfter(t *testing.T) {
+	mr := useTestRedis(t)
+	enrollTOTP(t, "acct")
+	keyring := StaticKeyring([]byte("cookie-secret"))
+	cookie := sessionCookie(t, keyring)
+	r := stepUpRouter(map[string]gin.HandlerFunc{
+		"/phone": authMiddleware(StepUpAuthenticator(keyring, StepUpOptions{Class: "phone-decrypt"})),
+	})
+	request := func(code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/phone", nil)
+		req.AddCookie(cookie)
+		req.Header.Set("X-TOTP-Code", code)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	wrong := "000000"
+	if currentTOTP(t) == wrong {
+		wrong = "111111"
+	}
+	for i := int64(1); i < TOTPMaxFailures; i++ {
+		if w := request(wrong); w.Code != http.StatusForbidden {
+			t.Fatalf("failure %d: status = %d, want 403", i, w.Code)
+		}
+	}
+	w := request(wrong)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("locking failure: status = %d, want 429", w.Code)
+	}
+	if got, want := w.Header().Get("Retry-After"), strconv.Itoa(int(TOTPLockoutBase/time.Second)); got != want {
+		t.Fatalf("Retry-After = %q, want %q", got, want)
+	}
+
+	// 锁定期间即使验证码正确也拒绝，Retry-After 为剩余时间
+	mr.FastForward(TOTPLockoutBase / 2)
+	w = request(currentTOTP(t))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked with valid code: status = %d, want 429", w.Code)
+	}
+	if got, want := w.Header().Get("Retry-After"), strconv.Itoa(int(TOTPLockoutBase/2/time.Second)); got != want {
+		t.Fatalf("Retry-After = %q, want %q", got, want)
+	}
+
+	mr.FastForward(TOTPLockoutBase / 2)
+	if w := request(currentTOTP(t)); w.Code != http.StatusOK {
+		t.Fatalf("after lockout: status = %d, want 200", w.Code)
+	}
+}
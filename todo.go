@@ -2,16 +2,47 @@ package middle
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
 	r2redis "github.com/open4go/db/redis"
 	"github.com/open4go/log"
 	v9 "github.com/redis/go-redis/v9"
 )
 
+// ErrRedisUnavailable 没有可用的 middle redis 连接
+var ErrRedisUnavailable = errors.New("middle redis is unavailable")
+
+var middleRedisClient atomic.Pointer[v9.Client]
+
+// SetMiddleRedis 指定本包使用的 redis 连接，优先于 DBPool 中的 middle
+// 便于自行管理连接或在测试中注入，传入 nil 时恢复使用 DBPool
+func SetMiddleRedis(client *v9.Client) {
+	middleRedisClient.Store(client)
+}
+
 // GetRedisMiddleHandler 获取数据库handler 这里定义一个方法
+// 连接不可用时直接退出，本包内部使用 middleRedis 返回错误
 func GetRedisMiddleHandler(ctx context.Context) *v9.Client {
-	handler, err := r2redis.DBPool.GetHandler("middle")
+	handler, err := middleRedis(ctx)
 	if err != nil {
 		log.Log(ctx).Fatal(err)
 	}
 	return handler
 }
+
+// middleRedis 返回 middle redis 连接，未配置时返回 ErrRedisUnavailable
+func middleRedis(ctx context.Context) (*v9.Client, error) {
+	if client := middleRedisClient.Load(); client != nil {
+		return client, nil
+	}
+	if r2redis.DBPool == nil {
+		return nil, ErrRedisUnavailable
+	}
+	handler, err := r2redis.DBPool.GetHandler("middle")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRedisUnavailable, err)
+	}
+	return handler, nil
+}
@@ -0,0 +1,144 @@
+package middle
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// TOTPUsedKeyPrefix 已使用的 (账号, 时间片)，防止同一验证码在有效期内被重放
+	TOTPUsedKeyPrefix = "2fa:used:"
+	// TOTPFailureKeyPrefix 失败次数，分别按账号与 ip 计数
+	TOTPFailureKeyPrefix = "2fa:fail:"
+	// TOTPLockKeyPrefix 锁定标记，ttl 即剩余锁定时间
+	TOTPLockKeyPrefix = "2fa:lock:"
+	// TOTPLockLevelKeyPrefix 连续锁定次数，用于逐级延长锁定时间
+	TOTPLockLevelKeyPrefix = "2fa:locklevel:"
+)
+
+var (
+	// TOTPMaxFailures 窗口期内允许的失败次数，超过后锁定
+	TOTPMaxFailures int64 = 5
+	// TOTPFailureWindow 失败次数的统计窗口
+	TOTPFailureWindow = 15 * time.Minute
+	// TOTPLockoutBase 首次锁定时长，之后每次翻倍
+	TOTPLockoutBase = time.Minute
+	// TOTPLockoutMax 最长锁定时长
+	TOTPLockoutMax = time.Hour
+	// TOTPLockLevelTTL 锁定等级的保留时间，期间再次锁定会翻倍
+	TOTPLockLevelTTL = 24 * time.Hour
+)
+
+// 安全事件类型
+const (
+	SecurityEventTOTPReplay  = "totp_replay"
+	SecurityEventTOTPLockout = "totp_lockout"
+)
+
+// incrWithTTLScript 计数加一并设置过期时间，保证计数不会因进程中断而永不过期
+// ARGV[2] 为 1 时每次都刷新过期时间，否则只在首次计数时设置
+var incrWithTTLScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 or ARGV[2] == '1' then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`)
+
+func incrWithTTL(ctx context.Context, handler *redis.Client, key string, ttl time.Duration, refresh bool) (int64, error) {
+	flag := "0"
+	if refresh {
+		flag = "1"
+	}
+	return incrWithTTLScript.Run(ctx, handler, []string{key},
+		strconv.FormatInt(ttl.Milliseconds(), 10), flag).Int64()
+}
+
+// totpSubjects 失败计数与锁定的对象，账号与 ip 分别计数
+func totpSubjects(accountID string, ip string) []string {
+	return []string{"account:" + accountID, "ip:" + ip}
+}
+
+// totpLockRemaining 返回剩余锁定时间，未锁定时为 0
+func totpLockRemaining(ctx context.Context, accountID string, ip string) (time.Duration, error) {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var remaining time.Duration
+	for _, s := range totpSubjects(accountID, ip) {
+		ttl, err := handler.PTTL(ctx, TOTPLockKeyPrefix+s).Result()
+		if err != nil {
+			return 0, err
+		}
+		if ttl > remaining {
+			remaining = ttl
+		}
+	}
+	return remaining, nil
+}
+
+// recordTOTPFailure 记录一次失败，达到上限时逐级锁定并返回锁定时长
+func recordTOTPFailure(ctx context.Context, accountID string, ip string) (time.Duration, error) {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var locked time.Duration
+	for _, s := range totpSubjects(accountID, ip) {
+		key := TOTPFailureKeyPrefix + s
+		n, err := incrWithTTL(ctx, handler, key, TOTPFailureWindow, false)
+		if err != nil {
+			return 0, err
+		}
+		if n < TOTPMaxFailures {
+			continue
+		}
+
+		level, err := incrWithTTL(ctx, handler, TOTPLockLevelKeyPrefix+s, TOTPLockLevelTTL, true)
+		if err != nil {
+			return 0, err
+		}
+
+		d := lockoutDuration(level)
+		pipe := handler.TxPipeline()
+		pipe.Set(ctx, TOTPLockKeyPrefix+s, level, d)
+		pipe.Del(ctx, key)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return 0, err
+		}
+		emitSecurityEvent(ctx, SecurityEvent{
+			Type:      SecurityEventTOTPLockout,
+			AccountID: accountID,
+			ClientIP:  ip,
+			Detail:    map[string]string{"subject": s, "duration": d.String()},
+		})
+		if d > locked {
+			locked = d
+		}
+	}
+	return locked, nil
+}
+
+func lockoutDuration(level int64) time.Duration {
+	d := TOTPLockoutBase
+	for i := int64(1); i < level && d < TOTPLockoutMax; i++ {
+		d *= 2
+	}
+	if d > TOTPLockoutMax {
+		d = TOTPLockoutMax
+	}
+	return d
+}
+
+// resetTOTPFailures 验证成功后清除账号的失败计数，ip 的计数保留
+func resetTOTPFailures(ctx context.Context, accountID string) error {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return err
+	}
+	return handler.Del(ctx, TOTPFailureKeyPrefix+"account:"+accountID).Err()
+}
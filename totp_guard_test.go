@@ -0,0 +1,39 @@
+package middle
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRecordTOTPFailureSetsExpiry(t *testing.T) {
+	mr := useTestRedis(t)
+	ctx := context.Background()
+
+	if _, err := recordTOTPFailure(ctx, "acct", "1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range totpSubjects("acct", "1.2.3.4") {
+		if ttl := mr.TTL(TOTPFailureKeyPrefix + s); ttl != TOTPFailureWindow {
+			t.Fatalf("%s ttl = %v, want %v", s, ttl, TOTPFailureWindow)
+		}
+	}
+
+	var locked bool
+	for i := int64(1); i < TOTPMaxFailures; i++ {
+		d, err := recordTOTPFailure(ctx, "acct", "1.2.3.4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		locked = d > 0
+	}
+	if !locked {
+		t.Fatal("expected lockout after max failures")
+	}
+	if ttl := mr.TTL(TOTPLockLevelKeyPrefix + "account:acct"); ttl != TOTPLockLevelTTL {
+		t.Fatalf("lock level ttl = %v, want %v", ttl, TOTPLockLevelTTL)
+	}
+	remaining, err := totpLockRemaining(ctx, "acct", "5.6.7.8")
+	if err != nil || remaining != TOTPLockoutBase {
+		t.Fatalf("remaining = %v, %v, want %v", remaining, err, TOTPLockoutBase)
+	}
+}
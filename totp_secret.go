@@ -0,0 +1,54 @@
+package middle
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// SecondFactorSecretKeyPrefix 二次验证密钥，按账号保存在服务端
+	SecondFactorSecretKeyPrefix = "2fa:secret:"
+)
+
+// ErrSecondFactorNotEnrolled 账号没有绑定二次验证
+var ErrSecondFactorNotEnrolled = errors.New("second factor is not enrolled")
+
+// SetSecondFactorSecret 保存账号的 TOTP 密钥，通常在绑定或登陆时调用
+// 密钥不再写入 cookie，SecondValidateMiddleware 只从这里读取
+func SetSecondFactorSecret(ctx context.Context, accountID string, secret string) error {
+	if accountID == "" {
+		return errors.New("accountID is required")
+	}
+	if secret == "" {
+		return DeleteSecondFactorSecret(ctx, accountID)
+	}
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return err
+	}
+	return handler.Set(ctx, SecondFactorSecretKeyPrefix+accountID, secret, 0).Err()
+}
+
+// GetSecondFactorSecret 读取账号的 TOTP 密钥
+func GetSecondFactorSecret(ctx context.Context, accountID string) (string, error) {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return "", err
+	}
+	secret, err := handler.Get(ctx, SecondFactorSecretKeyPrefix+accountID).Result()
+	if errors.Is(err, redis.Nil) || (err == nil && secret == "") {
+		return "", ErrSecondFactorNotEnrolled
+	}
+	return secret, err
+}
+
+// DeleteSecondFactorSecret 解绑二次验证
+func DeleteSecondFactorSecret(ctx context.Context, accountID string) error {
+	handler, err := middleRedis(ctx)
+	if err != nil {
+		return err
+	}
+	return handler.Del(ctx, SecondFactorSecretKeyPrefix+accountID).Err()
+}
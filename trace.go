@@ -2,7 +2,6 @@ package middle
 
 import (
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/open4go/log"
 	"github.com/sirupsen/logrus"
 )
@@ -11,14 +10,8 @@ import (
 func TraceMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
-		// Generate a UUID for the request ID
-		requestID := uuid.New().String()
-
-		// Set the request ID in the request context for later use
-		c.Set("RequestID", requestID)
-
-		// Pass the request ID in the response headers
-		c.Header("X-Request-ID", requestID)
+		// 与 CORSMiddleware 共用同一个关联 id，并在响应头中返回
+		requestID := bindCorrelation(c)
 
 		// Set the request ID in the Logrus logger's fields
 		logger := log.Log(c.Request.Context()).WithFields(
@@ -0,0 +1,86 @@
+package middle
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName 创建 tracer 时使用的名称
+const TracerName = "github.com/open4go/middle"
+
+// TracingOptions 链路追踪配置
+type TracingOptions struct {
+	// TracerProvider 为 nil 时使用 otel.GetTracerProvider()
+	TracerProvider trace.TracerProvider
+	// Propagator 为 nil 时使用 W3C trace context
+	Propagator propagation.TextMapPropagator
+}
+
+// TracingMiddleware 为每个请求创建 server span，名称为路由模板 c.FullPath()
+// 需挂载在认证中间件之前，请求结束时记录租户、账号、认证方式与状态码
+// 认证失败会以 auth.failure 事件记录在 span 上
+// 没有入站 traceparent 与 X-Request-ID 时，RequestID 使用 span 的 trace id
+func TracingMiddleware(opts TracingOptions) gin.HandlerFunc {
+	provider := opts.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	propagator := opts.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	tracer := provider.Tracer(TracerName)
+
+	return func(c *gin.Context) {
+		ctx := propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		name := route
+		if name == "" {
+			name = "HTTP " + c.Request.Method
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", c.Request.URL.Path),
+				attribute.String("client.address", c.ClientIP()),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		bindCorrelation(c)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		attrs := []attribute.KeyValue{attribute.Int("http.response.status_code", status)}
+		if scheme := AuthSchemeOf(c); scheme != "" {
+			attrs = append(attrs, attribute.String("auth.scheme", string(scheme)))
+		}
+		if tenant := tenantFromContext(c.Request.Context()); tenant != "" {
+			attrs = append(attrs, attribute.String("tenant.id", tenant))
+		}
+		if l, ok := Identity(c.Request.Context()); ok && l.AccountID != "" {
+			attrs = append(attrs, attribute.String("enduser.id", l.AccountID))
+		}
+		span.SetAttributes(attrs...)
+		if status >= 500 {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+	}
+}
+
+// tenantFromContext 认证中间件从已校验的来源写入的商户，没有时为空
+// 不读取 model.MerchantKey，它可能来自客户端传入的 X-Tenant-ID
+func tenantFromContext(ctx context.Context) string {
+	l, _ := Identity(ctx)
+	return l.MerchantID
+}
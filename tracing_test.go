@@ -0,0 +1,164 @@
+package middle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func tracedRequest(t *testing.T, token string, handler gin.HandlerFunc) sdktrace.ReadOnlySpan {
+	t.Helper()
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	t.Cleanup(func() { _ = tp.Shutdown(t.Context()) })
+
+	r := gin.New()
+	r.Use(TracingMiddleware(TracingOptions{TracerProvider: tp}))
+	r.GET("/orders/:id", JWTAuthMiddleware(testBearerSecret), handler)
+	req := httptest.NewRequest(http.MethodGet, "/orders/1", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("spans = %d, want 1", len(spans))
+	}
+	return spans[0]
+}
+
+func spanAttrs(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracingRecordsAuthenticatedRequest(t *testing.T) {
+	useTestRedis(t)
+	token := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": "j", "iss": "test", "aud": "app",
+		"exp": time.Now().Add(time.Hour).Unix(), TenantClaim: "t1"})
+	s := tracedRequest(t, token, func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	if s.Name() != "/orders/:id" {
+		t.Fatalf("name = %q", s.Name())
+	}
+	if s.Status().Code != codes.Unset {
+		t.Fatalf("status = %v", s.Status())
+	}
+	attrs := spanAttrs(s)
+	want := map[attribute.Key]string{
+		"http.route":          "/orders/:id",
+		"auth.scheme":         string(SchemeBearer),
+		"tenant.id":           "t1",
+		"enduser.id":          "acct",
+		"url.path":            "/orders/1",
+		"http.request.method": http.MethodGet,
+	}
+	for k, v := range want {
+		if got := attrs[k].AsString(); got != v {
+			t.Fatalf("%s = %q, want %q", k, got, v)
+		}
+	}
+	if got := attrs["http.response.status_code"].AsInt64(); got != http.StatusOK {
+		t.Fatalf("status code = %d", got)
+	}
+}
+
+func TestTracingRecordsAuthFailure(t *testing.T) {
+	useTestRedis(t)
+	s := tracedRequest(t, "", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	attrs := spanAttrs(s)
+	if got := attrs["auth.scheme"].AsString(); got != string(SchemeBearer) {
+		t.Fatalf("auth.scheme = %q", got)
+	}
+	if _, ok := attrs["enduser.id"]; ok {
+		t.Fatal("enduser.id should not be set")
+	}
+	var reason string
+	for _, e := range s.Events() {
+		if e.Name != "auth.failure" {
+			continue
+		}
+		for _, kv := range e.Attributes {
+			if kv.Key == "auth.reason" {
+				reason = kv.Value.AsString()
+			}
+		}
+	}
+	if reason != AuthCodeMissingHeader {
+		t.Fatalf("auth.reason = %q, want %q", reason, AuthCodeMissingHeader)
+	}
+}
+
+func TestTracingMarksServerErrors(t *testing.T) {
+	useTestRedis(t)
+	token := signBearer(t, jwt.MapClaims{"sub": "acct", "jti": "j", "iss": "test", "aud": "app",
+		"exp": time.Now().Add(time.Hour).Unix()})
+	s := tracedRequest(t, token, func(c *gin.Context) { c.Status(http.StatusInternalServerError) })
+
+	if s.Status().Code != codes.Error || s.Status().Description != "500" {
+		t.Fatalf("status = %v", s.Status())
+	}
+	if _, ok := spanAttrs(s)["tenant.id"]; ok {
+		t.Fatal("tenant.id should not be set without a verified tenant")
+	}
+}
+
+func TestTracingRequestIDMatchesSpan(t *testing.T) {
+	cases := []struct {
+		name      string
+		cors      bool
+		requestID string
+	}{
+		{"tracing only", false, ""},
+		{"cors mounted before tracing", true, ""},
+		{"inbound request id", false, "req-1"},
+	}
+	for _, tc := range cases {
+		sr := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+		r := gin.New()
+		if tc.cors {
+			r.Use(CORSMiddleware("https://admin.example.com"))
+		}
+		r.Use(TracingMiddleware(TracingOptions{TracerProvider: tp}), CorrelationMiddleware())
+		var id, legacyID string
+		r.GET("/res", func(c *gin.Context) {
+			id = RequestID(c.Request.Context())
+			legacyID, _ = c.Request.Context().Value(LegacyTraceIDKey).(string)
+			c.Status(http.StatusOK)
+		})
+		req := httptest.NewRequest(http.MethodGet, "/res", nil)
+		if tc.requestID != "" {
+			req.Header.Set(RequestIDHeader, tc.requestID)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		_ = tp.Shutdown(t.Context())
+
+		spans := sr.Ended()
+		if len(spans) != 1 {
+			t.Fatalf("%s: spans = %d, want 1", tc.name, len(spans))
+		}
+		want := spans[0].SpanContext().TraceID().String()
+		if tc.requestID != "" {
+			want = tc.requestID
+		}
+		if id != want || legacyID != want || w.Header().Get(RequestIDHeader) != want {
+			t.Errorf("%s: RequestID = %q, legacy = %q, header = %q, want %q",
+				tc.name, id, legacyID, w.Header().Get(RequestIDHeader), want)
+		}
+	}
+}
@@ -40,10 +40,11 @@ type LoginInfo struct {
 	// LoginLevel 登陆用户等级
 	LoginLevel string `json:"login_level"  bson:"login_level"`
 	// 用于二次验证权限的接口，如解密手机号等
-	OPTSecret string `json:"os"  bson:"os"`
+	// 不参与 json 序列化，避免随 cookie 泄露，服务端通过 Store 保存
+	OPTSecret string `json:"-"  bson:"os"`
 }
 
-// Dump 登陆信息
+// Dump 登陆信息，optSecret 不写入返回的字符串，需要另外调用 Store 保存
 func (l *LoginInfo) Dump(merchant string,
 	userId string,
 	phone string,
@@ -75,6 +76,14 @@ func (l *LoginInfo) Dump(merchant string,
 	return sEnc, nil
 }
 
+// Store 在服务端保存账号的二次验证密钥，登陆时在 Dump 之后调用，optSecret 为空时不做处理
+func (l *LoginInfo) Store(ctx context.Context, accountId string, optSecret string) error {
+	if optSecret == "" {
+		return nil
+	}
+	return SetSecondFactorSecret(ctx, accountId, optSecret)
+}
+
 func DumpLoginInfo(l LoginInfo) string {
 	payload, err := json.Marshal(l)
 	if err != nil {
@@ -99,7 +108,11 @@ func (l *LoginInfo) Load(payload string) error {
 }
 
 // LoadFromHeader 从登陆后的头部信息解析登陆信息
+// 认证中间件已写入 Identity 时优先使用，不再读取可被伪造的头部
 func LoadFromHeader(c *gin.Context) LoginInfo {
+	if l, ok := Identity(c.Request.Context()); ok {
+		return l
+	}
 	return LoginInfo{
 		Namespace:  c.GetHeader("Namespace"),
 		AccountID:  c.GetHeader("AccountID"),
@@ -185,5 +198,9 @@ func (l *LoginInfo) WriteIntoHeader(c *gin.Context) {
 	if isSuperDomain {
 		ctx = context.WithValue(ctx, model.NamespaceKey, "*")
 	}
+	if l.AccountID != "" {
+		// MerchantID 保持登陆时绑定的商户，当前访问的租户通过 model.MerchantKey 获取
+		ctx = withIdentity(ctx, *l)
+	}
 	c.Request = c.Request.WithContext(ctx)
 }
@@ -0,0 +1,56 @@
+package middle
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDumpKeepsSecretOutOfPayload(t *testing.T) {
+	// 没有配置 middle redis 时 Dump 同样可用
+	SetMiddleRedis(nil)
+	var l LoginInfo
+	payload, err := l.Dump("m1", "u1", "", "", "admin", "alice", "acct", "1", "JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "JBSWY3DPEHPK3PXP") {
+		t.Fatalf("secret leaked into payload: %s", raw)
+	}
+
+	var loaded LoginInfo
+	if err := loaded.Load(payload); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.AccountID != "acct" || loaded.OPTSecret != "" {
+		t.Fatalf("loaded = %+v", loaded)
+	}
+}
+
+func TestStoreKeepsSecretServerSide(t *testing.T) {
+	ctx := context.Background()
+	var l LoginInfo
+	SetMiddleRedis(nil)
+	if err := l.Store(ctx, "acct", "JBSWY3DPEHPK3PXP"); !errors.Is(err, ErrRedisUnavailable) {
+		t.Fatalf("store without redis = %v, want %v", err, ErrRedisUnavailable)
+	}
+
+	useTestRedis(t)
+	if err := l.Store(ctx, "acct", "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatal(err)
+	}
+	// 为空时保留已保存的密钥
+	if err := l.Store(ctx, "acct", ""); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := GetSecondFactorSecret(ctx, "acct")
+	if err != nil || secret != "JBSWY3DPEHPK3PXP" {
+		t.Fatalf("stored secret = %q, %v", secret, err)
+	}
+}
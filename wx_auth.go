@@ -1,8 +1,10 @@
 package middle
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/open4go/log"
+	"github.com/redis/go-redis/v9"
 	"net/http"
 )
 
@@ -22,23 +24,43 @@ var (
 
 // VerifyTokenMiddleware 微信登陆token校验
 func VerifyTokenMiddleware(key []byte) gin.HandlerFunc {
-	return func(c *gin.Context) {
+	return authMiddleware(WxAuthenticator())
+}
+
+// WxAuthenticator VerifyTokenMiddleware 的认证步骤，可在 AuthRegistry 中使用
+func WxAuthenticator() Authenticator {
+	return func(c *gin.Context) bool {
+		setAuthScheme(c, SchemeWx)
+		stripUntrustedIdentityHeaders(c)
 		token := c.Request.Header.Get("token")
 		hashParentKey := WxLoginSessionTokenKeyPrefix + token
 		for _, subKey := range WxLoginFields {
 			err := readCacheByToken(c, hashParentKey, subKey)
+			if err != nil && !errors.Is(err, redis.Nil) {
+				// 存储不可用时返回 503，客户端不应当作登陆失效处理
+				log.Log(c.Request.Context()).WithField("subKey", subKey).Error(err)
+				abortUnavailable(c, AuthCodeSessionUnavailable, "login session store is unavailable")
+				return false
+			}
 			if err != nil {
 				log.Log(c.Request.Context()).WithField("subKey", subKey).Error(err)
+				recordAuthFailure(c, AuthCodeInvalidToken)
 				c.AbortWithStatus(http.StatusForbidden)
-				return
+				return false
 			}
 		}
-		c.Next()
+		ctx := withIdentity(c.Request.Context(), LoginInfo{AccountID: c.Request.Header.Get("ACCOUNT_ID")})
+		c.Request = c.Request.WithContext(ctx)
+		return true
 	}
 }
 
 func readCacheByToken(c *gin.Context, tokenKeyName string, subKey string) error {
-	value, err := GetRedisMiddleHandler(c.Request.Context()).HGet(c.Request.Context(), tokenKeyName, subKey).Result()
+	handler, err := middleRedis(c.Request.Context())
+	if err != nil {
+		return err
+	}
+	value, err := handler.HGet(c.Request.Context(), tokenKeyName, subKey).Result()
 	if err != nil {
 		log.Log(c.Request.Context()).WithField("subKey", subKey).Error(err)
 		return err